@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"socks5-server-ng/pkg/filewatch"
+	"socks5-server-ng/pkg/geoip"
+	"socks5-server-ng/pkg/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GeoSet is a set of country codes and ASNs, eg. "DE,FR,AS3320"
+type GeoSet struct {
+	Countries []string
+	ASNs      []uint
+}
+
+func ParseGeoSet(spec string) (*GeoSet, error) {
+	ret := &GeoSet{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.ToUpper(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		if strings.HasPrefix(part, "AS") {
+			asn, err := strconv.ParseUint(part[2:], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ASN: %s", part)
+			}
+			ret.ASNs = append(ret.ASNs, uint(asn))
+			continue
+		}
+		if len(part) != 2 {
+			return nil, fmt.Errorf("invalid country code: %s", part)
+		}
+		ret.Countries = append(ret.Countries, part)
+	}
+	return ret, nil
+}
+
+// Match returns what matched info, eg. "country DE" or "AS3320", or an empty string
+func (s *GeoSet) Match(info geoip.Info) string {
+	if s == nil {
+		return ""
+	}
+	if info.Country != "" && containsString(s.Countries, info.Country) {
+		return "country " + info.Country
+	}
+	for _, asn := range s.ASNs {
+		if info.ASN != 0 && asn == info.ASN {
+			return fmt.Sprintf("AS%d", asn)
+		}
+	}
+	return ""
+}
+
+// GeoFilter denies addresses in Deny, and when Allow is set, only allows
+// addresses in Allow. Addresses the databases don't know, such as private
+// networks, are never denied.
+type GeoFilter struct {
+	DB    geoip.Lookuper
+	Allow *GeoSet
+	Deny  *GeoSet
+}
+
+// check returns why ip is denied, or an empty string if it isn't
+func (s *GeoFilter) check(ip net.IP) string {
+	info := s.DB.Lookup(ip)
+	if info.IsZero() {
+		return ""
+	}
+	if match := s.Deny.Match(info); match != "" {
+		return match + " is denied"
+	}
+	if s.Allow != nil && s.Allow.Match(info) == "" {
+		if info.Country == "" {
+			return fmt.Sprintf("AS%d is not allowed", info.ASN)
+		}
+		return fmt.Sprintf("country %s is not allowed", info.Country)
+	}
+	return ""
+}
+
+// GeoClientFilter is a ClientFilter by country and ASN of the client
+type GeoClientFilter struct {
+	GeoFilter
+}
+
+var _ socks5.ClientFilter = &GeoClientFilter{}
+
+func (s *GeoClientFilter) Allowed(ip net.IP) bool {
+	if reason := s.check(ip); reason != "" {
+		logrus.Debugf("Client %v filtered, %s", ip, reason)
+		return false
+	}
+	return true
+}
+
+// GeoRuleSet is an implementation of the RuleSet which filters destinations
+// by country and ASN of their resolved address.
+// UDP associate requests are checked for each datagram target, as the
+// address in the associate request itself is the client's.
+type GeoRuleSet struct {
+	GeoFilter
+}
+
+func (s *GeoRuleSet) Allow(ctx context.Context, req *socks5.Request) bool {
+	return s.Evaluate(ctx, req).Verdict != socks5.VerdictDeny
+}
+
+func (s *GeoRuleSet) Evaluate(ctx context.Context, req *socks5.Request) socks5.Decision {
+	if req.DestAddr.IP == nil || (req.Command == socks5.AssociateCommand && !req.Datagram) {
+		return socks5.Decision{}
+	}
+	if reason := s.check(req.DestAddr.IP); reason != "" {
+		return socks5.Decision{
+			Verdict: socks5.VerdictDeny,
+			Reason:  fmt.Sprintf("%v: %s", req.DestAddr.IP, reason),
+		}
+	}
+	return socks5.Decision{}
+}
+
+// openGeoIP opens each database, and reloads it when its file changes
+func openGeoIP(paths []string, pollInterval time.Duration) (geoip.Databases, error) {
+	var dbs geoip.Databases
+	for _, path := range paths {
+		db, err := geoip.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Infof("Loaded GeoIP database %s (%s)", path, db.Type())
+
+		filewatch.Watch(path, pollInterval, func() {
+			if err := db.Reload(); err != nil {
+				logrus.Warnf("Failed to reload GeoIP database %s: %v", db.Path(), err)
+				return
+			}
+			logrus.Infof("Reloaded GeoIP database %s", db.Path())
+		})
+		dbs = append(dbs, db)
+	}
+	return dbs, nil
+}
+
+// newGeoFilter parses the allowed and denied sets, either of which may be empty
+func newGeoFilter(db geoip.Lookuper, allow, deny string) (ret GeoFilter, err error) {
+	ret.DB = db
+	if allow != "" {
+		if ret.Allow, err = ParseGeoSet(allow); err != nil {
+			return
+		}
+	}
+	if deny != "" {
+		ret.Deny, err = ParseGeoSet(deny)
+	}
+	return
+}
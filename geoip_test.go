@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"socks5-server-ng/pkg/geoip"
+	"socks5-server-ng/pkg/go-socks5"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeGeoDB map[string]geoip.Info
+
+func (s fakeGeoDB) Lookup(ip net.IP) geoip.Info {
+	return s[ip.String()]
+}
+
+var testGeoDB = fakeGeoDB{
+	"1.1.1.1": {Country: "AU", ASN: 13335, Org: "CLOUDFLARENET"},
+	"2.2.2.2": {Country: "FR", ASN: 3215},
+	"3.3.3.3": {Country: "US", ASN: 16509},
+}
+
+func TestParseGeoSet(t *testing.T) {
+	set, err := ParseGeoSet("de, fr,AS3320")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DE", "FR"}, set.Countries)
+	assert.Equal(t, []uint{3320}, set.ASNs)
+
+	_, err = ParseGeoSet("germany")
+	assert.EqualError(t, err, "invalid country code: GERMANY")
+	_, err = ParseGeoSet("ASx")
+	assert.EqualError(t, err, "invalid ASN: ASX")
+}
+
+func TestGeoClientFilter(t *testing.T) {
+	filter, err := newGeoFilter(testGeoDB, "FR,AS13335", "")
+	assert.NoError(t, err)
+	f := &GeoClientFilter{filter}
+
+	assert.True(t, f.Allowed(net.ParseIP("1.1.1.1")))
+	assert.True(t, f.Allowed(net.ParseIP("2.2.2.2")))
+	assert.False(t, f.Allowed(net.ParseIP("3.3.3.3")))
+	assert.True(t, f.Allowed(net.ParseIP("192.168.1.1")), "unknown addresses are not filtered")
+}
+
+func TestGeoRuleSet(t *testing.T) {
+	filter, err := newGeoFilter(testGeoDB, "", "us")
+	assert.NoError(t, err)
+	rule := &GeoRuleSet{filter}
+
+	connect := func(ip string) *socks5.Request {
+		return &socks5.Request{Command: socks5.ConnectCommand, DestAddr: &socks5.AddrSpec{IP: net.ParseIP(ip), Port: 443}}
+	}
+
+	d := rule.Evaluate(context.Background(), connect("3.3.3.3"))
+	assert.Equal(t, socks5.VerdictDeny, d.Verdict)
+	assert.Equal(t, "3.3.3.3: country US is denied", d.Reason)
+	assert.True(t, rule.Allow(context.Background(), connect("2.2.2.2")))
+
+	// the associate request carries the client address, its targets are checked
+	assoc := &socks5.Request{Command: socks5.AssociateCommand, DestAddr: &socks5.AddrSpec{IP: net.ParseIP("3.3.3.3")}}
+	assert.True(t, rule.Allow(context.Background(), assoc))
+	assoc.Datagram = true
+	assert.False(t, rule.Allow(context.Background(), assoc))
+}
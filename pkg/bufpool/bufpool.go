@@ -5,72 +5,86 @@ import (
 	"sync/atomic"
 )
 
+// BufPool hands out buffers of a single size. Up to keep buffers are held in a
+// bounded channel, which survives garbage collections; any more spill into a
+// sync.Pool, whose per-P caches are cleared by the GC
 type BufPool struct {
-	size int
-	keep int
-	pool [][]byte
-	mux  sync.Mutex
+	size     int
+	free     chan []byte
+	overflow sync.Pool
 
 	leased, misses atomic.Int64
 }
 
 func New(size, keep int) *BufPool {
+	if keep < 0 {
+		keep = 0
+	}
 	return &BufPool{
 		size: size,
-		keep: keep,
+		free: make(chan []byte, keep),
 	}
 }
 
-func (s *BufPool) Get() []byte {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+// Size is the length of the buffers of the pool
+func (s *BufPool) Size() int {
+	return s.size
+}
 
+func (s *BufPool) Get() []byte {
 	s.leased.Add(1)
 
-	if len(s.pool) == 0 {
-		s.misses.Add(1)
-		return make([]byte, s.size)
+	select {
+	case buf := <-s.free:
+		return buf
+	default:
+	}
+
+	if buf, ok := s.overflow.Get().(*[]byte); ok {
+		return *buf
 	}
 
-	end := len(s.pool) - 1
-	ret := s.pool[end]
-	s.pool = s.pool[:end]
-	return ret
+	s.misses.Add(1)
+	return make([]byte, s.size)
 }
 
+// Return gives a buffer back to the pool, and returns whether it was kept
+// in the bounded channel. Buffers of another size are dropped
 func (s *BufPool) Return(buf []byte) bool {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-
+	if cap(buf) != s.size {
+		return false
+	}
 	s.leased.Add(-1)
+	buf = buf[:s.size]
 
-	if len(s.pool) < s.keep {
-		s.pool = append(s.pool, buf)
+	select {
+	case s.free <- buf:
 		return true
+	default:
 	}
+
+	s.overflow.Put(&buf)
 	return false
 }
 
-func (s *BufPool) ReturnMany(buf ...[]byte) int {
-	s.mux.Lock()
-	defer s.mux.Unlock()
-
-	s.leased.Add(-int64(len(buf)))
-
-	toAdd := s.keep - len(s.pool)
-	if toAdd > 0 {
-		s.pool = append(s.pool, buf[:toAdd]...)
+// ReturnMany returns several buffers, and how many were kept in the bounded
+// channel
+func (s *BufPool) ReturnMany(bufs ...[]byte) int {
+	kept := 0
+	for _, buf := range bufs {
+		if s.Return(buf) {
+			kept++
+		}
 	}
-
-	return toAdd
+	return kept
 }
 
 func (s *BufPool) MetricMaxSize() int {
-	return s.keep
+	return cap(s.free)
 }
 
 func (s *BufPool) MetricPoolSize() int {
-	return len(s.pool)
+	return len(s.free)
 }
 
 func (s *BufPool) MetricLeased() int64 {
@@ -1,6 +1,7 @@
 package bufpool
 
 import (
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -9,7 +10,7 @@ import (
 func TestBufPool(t *testing.T) {
 	p := New(128, 5)
 
-	assert.Len(t, p.pool, 0)
+	assert.Equal(t, 0, p.MetricPoolSize())
 
 	items := [][]byte{
 		p.Get(),
@@ -21,15 +22,85 @@ func TestBufPool(t *testing.T) {
 	}
 	assert.Len(t, items, 6)
 	assert.NotNil(t, items[3])
+	assert.Equal(t, int64(6), p.MetricLeased())
+	assert.Equal(t, int64(6), p.MetricMisses())
 
 	added := p.ReturnMany(items...)
 	assert.Equal(t, 5, added)
-	assert.Len(t, p.pool, 5)
+	assert.Equal(t, 5, p.MetricPoolSize())
+	assert.Equal(t, int64(0), p.MetricLeased())
 
 	ng := p.Get()
 	assert.NotNil(t, ng)
-	assert.Len(t, p.pool, 4)
+	assert.Equal(t, 4, p.MetricPoolSize())
 
 	assert.True(t, p.Return(ng))
-	assert.Len(t, p.pool, 5)
+	assert.Equal(t, 5, p.MetricPoolSize())
+}
+
+func TestBufPoolReturnFewerThanFree(t *testing.T) {
+	p := New(64, 10)
+
+	added := p.ReturnMany(p.Get(), p.Get())
+	assert.Equal(t, 2, added)
+	assert.Equal(t, 2, p.MetricPoolSize())
+}
+
+func TestBufPoolForeignBuffer(t *testing.T) {
+	p := New(64, 10)
+
+	assert.False(t, p.Return(make([]byte, 32)))
+	assert.Equal(t, 0, p.MetricPoolSize())
+
+	// resliced buffers come back whole
+	assert.True(t, p.Return(p.Get()[:10]))
+	assert.Len(t, p.Get(), 64)
+}
+
+func TestPoolClasses(t *testing.T) {
+	p := NewPool(2, 16384, 4096, 65536, 4096)
+
+	sizes := []int{}
+	for _, class := range p.Classes() {
+		sizes = append(sizes, class.Size())
+	}
+	assert.Equal(t, []int{4096, 16384, 65536}, sizes)
+
+	assert.Len(t, p.Get(1), 4096)
+	assert.Len(t, p.Get(4096), 4096)
+	assert.Len(t, p.Get(4097), 16384)
+	assert.Len(t, p.Get(65507), 65536)
+	assert.Len(t, p.Get(100000), 100000)
+	assert.Equal(t, int64(1), p.Class(65507).MetricLeased())
+
+	assert.True(t, p.Return(p.Get(10000)))
+	assert.Equal(t, 1, p.Class(10000).MetricPoolSize())
+	assert.False(t, p.Return(make([]byte, 100000)))
+	assert.False(t, p.Return(make([]byte, 5000)))
+}
+
+func TestPool4096(t *testing.T) {
+	assert.Same(t, Default.Class(4096), Pool4096)
+	assert.Len(t, Pool4096.Get(), 4096)
+}
+
+func TestBufPoolConcurrent(t *testing.T) {
+	p := New(32, 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				buf := p.Get()
+				buf[0] = 1
+				p.Return(buf)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(0), p.MetricLeased())
+	assert.LessOrEqual(t, p.MetricPoolSize(), 4)
 }
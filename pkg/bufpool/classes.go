@@ -0,0 +1,59 @@
+package bufpool
+
+import "sort"
+
+// Pool is a set of BufPools of increasing sizes ("classes"). Requests are
+// served by the smallest class that fits
+type Pool struct {
+	classes []*BufPool
+}
+
+// NewPool creates a pool with a class for each size, each keeping up to keep
+// buffers
+func NewPool(keep int, sizes ...int) *Pool {
+	sorted := append([]int(nil), sizes...)
+	sort.Ints(sorted)
+
+	p := &Pool{}
+	for _, size := range sorted {
+		if size <= 0 || (len(p.classes) > 0 && p.classes[len(p.classes)-1].size == size) {
+			continue
+		}
+		p.classes = append(p.classes, New(size, keep))
+	}
+	return p
+}
+
+// Class is the smallest class holding at least size bytes, or nil if size
+// exceeds the largest class
+func (p *Pool) Class(size int) *BufPool {
+	i := sort.Search(len(p.classes), func(i int) bool {
+		return p.classes[i].size >= size
+	})
+	if i == len(p.classes) {
+		return nil
+	}
+	return p.classes[i]
+}
+
+// Get returns a buffer of at least size bytes, as long as its class. Sizes
+// larger than every class are allocated, and not pooled
+func (p *Pool) Get(size int) []byte {
+	if class := p.Class(size); class != nil {
+		return class.Get()
+	}
+	return make([]byte, size)
+}
+
+// Return gives a buffer back to the class it came from
+func (p *Pool) Return(buf []byte) bool {
+	if class := p.Class(cap(buf)); class != nil {
+		return class.Return(buf)
+	}
+	return false
+}
+
+// Classes are the pools of each size, smallest first
+func (p *Pool) Classes() []*BufPool {
+	return p.classes
+}
@@ -1,5 +1,15 @@
 package bufpool
 
+// Default sizes of the classes of the Default pool
+var DefaultSizes = []int{4096, 16384, 65536}
+
 var (
-	Pool4096 = New(4096, 100)
+	// Default is the pool shared by the proxy. Replace it before serving
+	// to change its classes
+	Default = NewPool(100, DefaultSizes...)
+
+	// Pool4096 is the 4K class of the initial Default pool.
+	//
+	// Deprecated: use Default.Get and Default.Return, or Default.Class(4096)
+	Pool4096 = Default.Class(4096)
 )
@@ -0,0 +1,156 @@
+package domainlist
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// List is a set of domains loaded from a file, which can be reloaded.
+// Supported formats, which can be mixed within a file:
+//
+//	example.com                 plain, one domain per line
+//	0.0.0.0 example.com foo.com hosts file
+//	||example.com^              AdBlock domain anchors (other AdBlock rules are ignored)
+//
+// Lines starting with '#' or '!' are comments.
+type List struct {
+	path string
+	trie atomic.Pointer[Trie]
+
+	loadedAt atomic.Value
+	Hits     atomic.Int64
+}
+
+// Open loads a list from a file
+func Open(path string) (*List, error) {
+	l := &List{path: path}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload loads the file again. On error, the previous contents are kept
+func (s *List) Reload() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	trie, err := Parse(f)
+	if err != nil {
+		return err
+	}
+
+	s.trie.Store(trie)
+	s.loadedAt.Store(time.Now())
+	return nil
+}
+
+// Match returns true if domain, or any of its parents, is in the list,
+// and counts a hit
+func (s *List) Match(domain string) bool {
+	if s.trie.Load().Match(domain) {
+		s.Hits.Add(1)
+		return true
+	}
+	return false
+}
+
+func (s *List) Path() string {
+	return s.path
+}
+
+// Len returns the number of domains in the list
+func (s *List) Len() int {
+	return s.trie.Load().Len()
+}
+
+func (s *List) LoadedAt() time.Time {
+	return s.loadedAt.Load().(time.Time)
+}
+
+// Parse reads a domain list into a Trie
+func Parse(r io.Reader) (*Trie, error) {
+	trie := NewTrie()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+
+		// AdBlock
+		if strings.HasPrefix(line, "||") {
+			domain := strings.TrimPrefix(line, "||")
+			if idx := strings.IndexByte(domain, '$'); idx >= 0 {
+				if idx == 0 || domain[idx-1] != '^' {
+					continue // domain options only apply to anchored domains
+				}
+				domain = domain[:idx]
+			}
+			if strings.HasSuffix(domain, "^") {
+				if domain = strings.TrimSuffix(domain, "^"); validDomain(domain) {
+					trie.Add(domain)
+				}
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		// Hosts
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			for _, domain := range fields[1:] {
+				if validDomain(domain) && !localHostname(domain) {
+					trie.Add(domain)
+				}
+			}
+			continue
+		}
+
+		// Plain
+		if len(fields) == 1 {
+			domain := strings.TrimPrefix(fields[0], "*.")
+			if validDomain(domain) {
+				trie.Add(domain)
+			}
+		}
+	}
+
+	return trie, scanner.Err()
+}
+
+func validDomain(domain string) bool {
+	if domain == "" || len(domain) > 253 {
+		return false
+	}
+	for i := 0; i < len(domain); i++ {
+		c := domain[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func localHostname(domain string) bool {
+	switch strings.ToLower(domain) {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback":
+		return true
+	}
+	return false
+}
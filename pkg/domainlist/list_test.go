@@ -0,0 +1,82 @@
+package domainlist
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	trie, err := Parse(strings.NewReader(`
+# comment
+! adblock comment
+example.com
+*.wild.org
+0.0.0.0 ads.net tracker.io # trailing
+127.0.0.1 localhost
+||adblock.com^
+||opts.com^$third-party
+||path.com/ads
+@@||exception.com^
+not a domain
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 6, trie.Len())
+
+	for _, domain := range []string{"example.com", "www.example.com", "wild.org", "a.wild.org", "ads.net", "tracker.io", "x.adblock.com", "opts.com", "EXAMPLE.com."} {
+		assert.True(t, trie.Match(domain), domain)
+	}
+	for _, domain := range []string{"", "com", "notexample.com", "localhost", "path.com", "exception.com", "example.org"} {
+		assert.False(t, trie.Match(domain), domain)
+	}
+}
+
+func TestTrieParentCoversChild(t *testing.T) {
+	trie := NewTrie()
+	trie.Add("a.example.com")
+	assert.False(t, trie.Match("example.com"))
+	assert.True(t, trie.Match("b.a.example.com"))
+
+	trie.Add("example.com")
+	assert.True(t, trie.Match("example.com"))
+	trie.Add("c.example.com")
+	assert.Equal(t, 1, trie.Len())
+}
+
+func TestTrieLen(t *testing.T) {
+	tests := []struct {
+		domains []string
+		want    int
+	}{
+		{nil, 0},
+		{[]string{"example.com", "EXAMPLE.com.", "example.com"}, 1},
+		{[]string{"example.com", "example.org"}, 2},
+		{[]string{"example.com", "a.example.com", "b.a.example.com"}, 1},
+		{[]string{"b.a.example.com", "c.a.example.com", "a.example.com"}, 1},
+		{[]string{"b.a.example.com", "x.example.com", "a.example.com", "example.org"}, 3},
+		{[]string{"b.a.example.com", "x.example.com", "a.example.com", "example.com"}, 1},
+		{[]string{"a.example.com", "b.example.com", "com", "org"}, 2},
+	}
+	for _, tt := range tests {
+		trie := NewTrie()
+		for _, domain := range tt.domains {
+			trie.Add(domain)
+		}
+		assert.Equal(t, tt.want, trie.Len(), strings.Join(tt.domains, ","))
+	}
+}
+
+func BenchmarkTrieMatch(b *testing.B) {
+	trie := NewTrie()
+	for i := 0; i < 500000; i++ {
+		trie.Add(fmt.Sprintf("host%d.domain%d.com", i, i%1000))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Match("www.host123.domain123.com")
+		trie.Match("www.unknown.example.org")
+	}
+}
@@ -0,0 +1,106 @@
+package domainlist
+
+import "strings"
+
+// Trie matches domains, and all their subdomains, against a set of domains.
+// Domains are stored label by label, from the TLD down, so a lookup costs
+// one map access per label of the queried domain.
+type Trie struct {
+	edges    map[trieEdge]uint32
+	terminal []bool   // per node; node 0 is the root
+	below    []uint32 // per node, the number of domains added under it
+	count    int
+}
+
+type trieEdge struct {
+	parent uint32
+	label  string
+}
+
+func NewTrie() *Trie {
+	return &Trie{
+		edges:    make(map[trieEdge]uint32),
+		terminal: []bool{false},
+		below:    []uint32{0},
+	}
+}
+
+// Add inserts a domain; it, and all its subdomains, will match.
+// Subdomains added before it are then covered, and no longer counted.
+func (s *Trie) Add(domain string) {
+	domain = normalize(domain)
+	if domain == "" {
+		return
+	}
+
+	var stack [16]uint32
+	path := stack[:0]
+	node := uint32(0)
+	for rest := domain; rest != ""; {
+		path = append(path, node)
+
+		var label string
+		label, rest = lastLabel(rest)
+
+		edge := trieEdge{node, label}
+		next, ok := s.edges[edge]
+		if !ok {
+			next = uint32(len(s.terminal))
+			s.terminal = append(s.terminal, false)
+			s.below = append(s.below, 0)
+			s.edges[edge] = next
+		}
+		node = next
+
+		if s.terminal[node] {
+			// A parent domain is already present, which covers this one
+			return
+		}
+	}
+	s.terminal[node] = true
+	// the domain replaces the ones added under it
+	covered := s.below[node]
+	for _, parent := range path {
+		s.below[parent] = s.below[parent] + 1 - covered
+	}
+	s.count = s.count + 1 - int(covered)
+}
+
+// Match returns true if the domain, or any of its parent domains, was added
+func (s *Trie) Match(domain string) bool {
+	domain = normalize(domain)
+
+	node := uint32(0)
+	for rest := domain; rest != ""; {
+		var label string
+		label, rest = lastLabel(rest)
+
+		next, ok := s.edges[trieEdge{node, label}]
+		if !ok {
+			return false
+		}
+		if s.terminal[next] {
+			return true
+		}
+		node = next
+	}
+	return false
+}
+
+// Len returns the number of domains added, not covered by a parent domain
+func (s *Trie) Len() int {
+	return s.count
+}
+
+// lastLabel splits the right-most label off a domain
+func lastLabel(domain string) (label, rest string) {
+	idx := strings.LastIndexByte(domain, '.')
+	if idx < 0 {
+		return domain, ""
+	}
+	return domain[idx+1:], domain[:idx]
+}
+
+func normalize(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
@@ -0,0 +1,48 @@
+package filewatch
+
+import (
+	"os"
+	"time"
+)
+
+// Watch polls a file every interval, and invokes onChange when its size
+// or modification time changed. It returns a function that stops watching.
+func Watch(path string, interval time.Duration, onChange func()) (stop func()) {
+	done := make(chan struct{})
+	last := stat(path)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				cur := stat(path)
+				if cur != last {
+					last = cur
+					onChange()
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+type fileState struct {
+	size    int64
+	modTime int64
+}
+
+func stat(path string) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{}
+	}
+	return fileState{info.Size(), info.ModTime().UnixNano()}
+}
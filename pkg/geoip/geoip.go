@@ -0,0 +1,123 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Info is what the databases know of an address. Fields are empty when unknown
+type Info struct {
+	Country string // ISO 3166-1 alpha-2 code, eg. "DE"
+	ASN     uint
+	Org     string // organization owning the ASN
+}
+
+func (s Info) IsZero() bool {
+	return s.Country == "" && s.ASN == 0
+}
+
+// Lookuper looks up addresses
+type Lookuper interface {
+	Lookup(ip net.IP) Info
+}
+
+// record holds the fields used from GeoLite2/GeoIP2 Country, City and ASN databases
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+// DB is a MaxMind database loaded in memory from a .mmdb file, which can be reloaded
+type DB struct {
+	path   string
+	reader atomic.Pointer[maxminddb.Reader]
+
+	loadedAt atomic.Value
+}
+
+var _ Lookuper = &DB{}
+
+// Open loads a database from a file
+func Open(path string) (*DB, error) {
+	db := &DB{path: path}
+	if err := db.Reload(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload loads the file again. On error, the previous database is kept
+func (s *DB) Reload() error {
+	// read rather than mmap the file, so it can be replaced while in use
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.path, err)
+	}
+
+	s.reader.Store(reader)
+	s.loadedAt.Store(time.Now())
+	return nil
+}
+
+func (s *DB) Lookup(ip net.IP) Info {
+	var rec record
+	if err := s.reader.Load().Lookup(ip, &rec); err != nil {
+		return Info{}
+	}
+	info := Info{
+		Country: rec.Country.ISOCode,
+		ASN:     rec.ASN,
+		Org:     rec.Org,
+	}
+	if info.Country == "" {
+		info.Country = rec.RegisteredCountry.ISOCode
+	}
+	return info
+}
+
+func (s *DB) Path() string {
+	return s.path
+}
+
+// Type returns the database type, eg. "GeoLite2-Country"
+func (s *DB) Type() string {
+	return s.reader.Load().Metadata.DatabaseType
+}
+
+func (s *DB) LoadedAt() time.Time {
+	return s.loadedAt.Load().(time.Time)
+}
+
+// Databases looks up addresses in several databases, typically a country and
+// an ASN database, the first database knowing a field winning
+type Databases []*DB
+
+var _ Lookuper = Databases{}
+
+func (s Databases) Lookup(ip net.IP) (ret Info) {
+	for _, db := range s {
+		info := db.Lookup(ip)
+		if ret.Country == "" {
+			ret.Country = info.Country
+		}
+		if ret.ASN == 0 {
+			ret.ASN, ret.Org = info.ASN, info.Org
+		}
+	}
+	return
+}
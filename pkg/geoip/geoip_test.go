@@ -0,0 +1,39 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testdata/test.mmdb maps 1.0.0.0/8 to AU, AS13335
+func TestLookup(t *testing.T) {
+	db, err := Open("testdata/test.mmdb")
+	assert.NoError(t, err)
+
+	assert.Equal(t, Info{Country: "AU", ASN: 13335, Org: "CLOUDFLARENET"}, db.Lookup(net.ParseIP("1.1.1.1")))
+	assert.True(t, db.Lookup(net.ParseIP("8.8.8.8")).IsZero())
+	assert.True(t, db.Lookup(net.ParseIP("::1")).IsZero())
+	assert.Equal(t, "Test-ASN-Country", db.Type())
+}
+
+func TestReload(t *testing.T) {
+	data, err := os.ReadFile("testdata/test.mmdb")
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	assert.NoError(t, os.WriteFile(path, data, 0o644))
+
+	db, err := Open(path)
+	assert.NoError(t, err)
+
+	// a broken file keeps the previous database
+	assert.NoError(t, os.WriteFile(path, []byte("garbage"), 0o644))
+	assert.Error(t, db.Reload())
+	assert.Equal(t, "AU", db.Lookup(net.ParseIP("1.1.1.1")).Country)
+
+	_, err = Open(path)
+	assert.Error(t, err)
+}
@@ -1,8 +1,12 @@
 package socks5
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 )
 
 const (
@@ -35,6 +39,61 @@ type Authenticator interface {
 	GetCode() uint8
 }
 
+// ContextAuthenticator is an Authenticator which is given the client
+// connection info. The Server uses AuthenticateConn when implemented
+type ContextAuthenticator interface {
+	Authenticator
+	AuthenticateConn(ctx context.Context, info *ConnInfo, reader io.Reader, writer io.Writer) (*AuthContext, error)
+}
+
+// OptionalAuthenticator is an Authenticator only available to some client
+// connections. For the others, the Server selects the next method the
+// client offers
+type OptionalAuthenticator interface {
+	Authenticator
+	Available(info *ConnInfo) bool
+}
+
+// ConnInfo describes the client connection being authenticated
+type ConnInfo struct {
+	// RemoteAddr is the address of the client
+	RemoteAddr net.Addr
+	// LocalAddr is the address of the listener the client connected to
+	LocalAddr net.Addr
+	// TLS is the state of the connection, nil if the client didn't use TLS
+	TLS *tls.ConnectionState
+}
+
+// newConnInfo describes conn, which is usually a net.Conn
+func newConnInfo(conn interface{}) *ConnInfo {
+	info := &ConnInfo{}
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		info.RemoteAddr = c.RemoteAddr()
+	}
+	if c, ok := conn.(interface{ LocalAddr() net.Addr }); ok {
+		info.LocalAddr = c.LocalAddr()
+	}
+	if c, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		state := c.ConnectionState()
+		info.TLS = &state
+	}
+	return info
+}
+
+// ClientIP returns the IP address of the client, or nil if unknown
+func (c *ConnInfo) ClientIP() net.IP {
+	if c == nil {
+		return nil
+	}
+	switch addr := c.RemoteAddr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
 // NoAuthAuthenticator is used to handle the "No Authentication" mode
 type NoAuthAuthenticator struct{}
 
@@ -43,6 +102,10 @@ func (a NoAuthAuthenticator) GetCode() uint8 {
 }
 
 func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	return a.AuthenticateConn(context.Background(), newConnInfo(writer), reader, writer)
+}
+
+func (a NoAuthAuthenticator) AuthenticateConn(ctx context.Context, info *ConnInfo, reader io.Reader, writer io.Writer) (*AuthContext, error) {
 	_, err := writer.Write([]byte{socks5Version, NoAuth})
 	return &AuthContext{NoAuth, nil}, err
 }
@@ -58,6 +121,23 @@ func (a UserPassAuthenticator) GetCode() uint8 {
 }
 
 func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	return a.AuthenticateConn(context.Background(), newConnInfo(writer), reader, writer)
+}
+
+func (a UserPassAuthenticator) AuthenticateConn(ctx context.Context, info *ConnInfo, reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	verifier := Verifier(a.Credentials)
+	return authenticateUserPass(reader, writer, func(user, pass string) (map[string]string, error) {
+		attrs, err := verifier.Verify(ctx, info, user, pass)
+		if errors.Is(err, UserAuthFailed) {
+			return nil, &UserAuthError{Username: user}
+		}
+		return attrs, err
+	})
+}
+
+// authenticateUserPass runs the username/password sub-negotiation, verify
+// returning the attributes added to the AuthContext Payload, or an error
+func authenticateUserPass(reader io.Reader, writer io.Writer, verify func(user, pass string) (map[string]string, error)) (*AuthContext, error) {
 	// Tell the client to use user/pass auth
 	if _, err := writer.Write([]byte{socks5Version, UserPassAuth}); err != nil {
 		return nil, err
@@ -94,23 +174,28 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 	}
 
 	// Verify the password
-	if a.Credentials.Valid(string(user), string(pass)) {
-		if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
-			return nil, err
-		}
-	} else {
-		if _, err := writer.Write([]byte{userAuthVersion, authFailure}); err != nil {
-			return nil, err
+	attrs, err := verify(string(user), string(pass))
+	if err != nil {
+		if _, werr := writer.Write([]byte{userAuthVersion, authFailure}); werr != nil {
+			return nil, werr
 		}
-		return nil, UserAuthFailed
+		return nil, err
+	}
+	if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
+		return nil, err
 	}
 
 	// Done
-	return &AuthContext{UserPassAuth, map[string]string{"Username": string(user)}}, nil
+	payload := map[string]string{}
+	for k, v := range attrs {
+		payload[k] = v
+	}
+	payload["Username"] = string(user)
+	return &AuthContext{UserPassAuth, payload}, nil
 }
 
 // authenticate is used to handle connection authentication
-func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext, error) {
+func (s *Server) authenticate(ctx context.Context, info *ConnInfo, conn io.Writer, bufConn io.Reader) (*AuthContext, error) {
 	// Get the methods
 	methods, err := readMethods(bufConn)
 	if err != nil {
@@ -120,9 +205,16 @@ func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext,
 	// Select a usable method
 	for _, method := range methods {
 		cator, found := s.authMethods[method]
-		if found {
-			return cator.Authenticate(bufConn, conn)
+		if !found {
+			continue
+		}
+		if cator, ok := cator.(OptionalAuthenticator); ok && !cator.Available(info) {
+			continue
+		}
+		if cator, ok := cator.(ContextAuthenticator); ok {
+			return cator.AuthenticateConn(ctx, info, bufConn, conn)
 		}
+		return cator.Authenticate(bufConn, conn)
 	}
 
 	// No usable method found
@@ -0,0 +1,61 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// infoVerifier records the ConnInfo it is called with
+type infoVerifier struct {
+	info chan *ConnInfo
+}
+
+func (v infoVerifier) Valid(user, password string) bool {
+	return false
+}
+
+func (v infoVerifier) Verify(ctx context.Context, info *ConnInfo, user, password string) (map[string]string, error) {
+	v.info <- info
+	return nil, UserAuthFailed
+}
+
+func TestServeConnInfo(t *testing.T) {
+	verifier := infoVerifier{make(chan *ConnInfo, 1)}
+	server, err := New(&Config{Credentials: verifier})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte{socks5Version, 1, UserPassAuth, userAuthVersion, 1, 'a', 1, 'b'})
+	resp, _ := io.ReadAll(conn)
+	assert.Equal(t, []byte{socks5Version, UserPassAuth, userAuthVersion, authFailure}, resp)
+
+	info := <-verifier.info
+	assert.Equal(t, conn.LocalAddr().String(), info.RemoteAddr.String())
+	assert.Equal(t, l.Addr().String(), info.LocalAddr.String())
+	assert.Nil(t, info.TLS)
+	assert.Equal(t, "127.0.0.1", info.ClientIP().String())
+}
+
+func TestVerifierAdapter(t *testing.T) {
+	v := Verifier(StaticCredentials{"bob": "secret"})
+	attrs, err := v.Verify(context.Background(), nil, "bob", "secret")
+	assert.NoError(t, err)
+	assert.Empty(t, attrs)
+	_, err = v.Verify(context.Background(), nil, "bob", "guess")
+	assert.ErrorIs(t, err, UserAuthFailed)
+
+	var info *ConnInfo
+	assert.Nil(t, info.ClientIP())
+}
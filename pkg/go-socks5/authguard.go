@@ -0,0 +1,295 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// UserAuthError is returned by UserPassAuthenticator when the credentials
+// are rejected. It matches UserAuthFailed with errors.Is
+type UserAuthError struct {
+	Username string
+}
+
+func (e *UserAuthError) Error() string {
+	return UserAuthFailed.Error()
+}
+
+func (e *UserAuthError) Is(target error) bool {
+	return target == UserAuthFailed
+}
+
+// BanKind is what a ban applies to
+type BanKind string
+
+const (
+	BanIP   BanKind = "ip"
+	BanUser BanKind = "user"
+)
+
+// Ban is a temporary ban of a client IP or username
+type Ban struct {
+	Kind  BanKind
+	Key   string
+	Until time.Time
+	Count int // number of bans, the duration doubling with each
+}
+
+// AuthGuardConfig configures an AuthGuard
+type AuthGuardConfig struct {
+	// MaxFailures is how many failures of an IP or username lead to a ban.
+	// Defaults to 5
+	MaxFailures int
+	// Delay is how long a client with failures waits before its handshake,
+	// doubled with each failure. Defaults to 250ms
+	Delay time.Duration
+	// BanTime is the duration of the first ban, doubled with each further
+	// ban. Defaults to 1m
+	BanTime time.Duration
+	// MaxBanTime caps the duration of a ban. Defaults to 24h
+	MaxBanTime time.Duration
+	// Forget is how long an IP or username is remembered after its last
+	// failure, after which its failures and bans start from 0 again.
+	// Defaults to, and is at least, MaxBanTime
+	Forget time.Duration
+}
+
+// AuthGuard tracks authentication failures per client IP and per username,
+// and bans them temporarily, fail2ban style.
+// Banned IPs are refused before the handshake, and banned usernames fail
+// authentication without their password being checked.
+type AuthGuard struct {
+	conf    AuthGuardConfig
+	entries *ttlcache.Cache[guardKey, *guardEntry]
+
+	// TotalBans is the number of bans so far
+	TotalBans atomic.Int64
+	// Refused is the number of connections and logins refused while banned
+	Refused atomic.Int64
+}
+
+type guardKey struct {
+	kind BanKind
+	key  string
+}
+
+type guardEntry struct {
+	mu       sync.Mutex
+	failures int
+	bans     int
+	until    time.Time
+}
+
+// NewAuthGuard creates an AuthGuard, and starts its expiration routine
+func NewAuthGuard(conf AuthGuardConfig) *AuthGuard {
+	if conf.MaxFailures <= 0 {
+		conf.MaxFailures = 5
+	}
+	if conf.Delay <= 0 {
+		conf.Delay = 250 * time.Millisecond
+	}
+	if conf.BanTime <= 0 {
+		conf.BanTime = time.Minute
+	}
+	if conf.MaxBanTime <= 0 {
+		conf.MaxBanTime = 24 * time.Hour
+	}
+	if conf.Forget < conf.MaxBanTime {
+		conf.Forget = conf.MaxBanTime
+	}
+
+	g := &AuthGuard{
+		conf: conf,
+		entries: ttlcache.New[guardKey, *guardEntry](
+			ttlcache.WithTTL[guardKey, *guardEntry](conf.Forget),
+			ttlcache.WithDisableTouchOnHit[guardKey, *guardEntry](),
+		),
+	}
+	go g.entries.Start()
+
+	return g
+}
+
+// Close stops the expiration routine
+func (s *AuthGuard) Close() {
+	s.entries.Stop()
+}
+
+func (s *AuthGuard) entry(kind BanKind, key string) *guardEntry {
+	if item := s.entries.Get(guardKey{kind, key}); item != nil {
+		return item.Value()
+	}
+	return nil
+}
+
+// Banned returns when the ban of an IP or username ends, or a zero time if
+// it isn't banned
+func (s *AuthGuard) Banned(kind BanKind, key string) time.Time {
+	e := s.entry(kind, key)
+	if e == nil {
+		return time.Time{}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Now().Before(e.until) {
+		return e.until
+	}
+	return time.Time{}
+}
+
+// Delay returns how long a client should wait before its handshake
+func (s *AuthGuard) Delay(ip net.IP) time.Duration {
+	e := s.entry(BanIP, ip.String())
+	if e == nil {
+		return 0
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.failures == 0 {
+		return 0
+	}
+	return s.backoff(s.conf.Delay, e.failures-1, s.conf.BanTime)
+}
+
+// backoff doubles base n times, up to max
+func (s *AuthGuard) backoff(base time.Duration, n int, max time.Duration) time.Duration {
+	d := base
+	for i := 0; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Fail records an authentication failure of a client IP, and of a username
+// if not empty, banning them when they reach MaxFailures
+func (s *AuthGuard) Fail(ip net.IP, username string) {
+	s.fail(BanIP, ip.String())
+	if username != "" {
+		s.fail(BanUser, username)
+	}
+}
+
+func (s *AuthGuard) fail(kind BanKind, key string) {
+	item, found := s.entries.GetOrSet(guardKey{kind, key}, &guardEntry{})
+	if found {
+		// remember for Forget after the last failure
+		s.entries.Touch(item.Key())
+	}
+
+	e := item.Value()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(e.until) {
+		// already banned, eg. a banned username
+		return
+	}
+	e.failures++
+	if e.failures >= s.conf.MaxFailures {
+		e.until = now.Add(s.backoff(s.conf.BanTime, e.bans, s.conf.MaxBanTime))
+		e.bans++
+		e.failures = 0
+		s.TotalBans.Add(1)
+	}
+}
+
+// Success resets the failures of a client IP and username, their bans
+// being still counted for the duration of the next one
+func (s *AuthGuard) Success(ip net.IP, username string) {
+	for _, key := range []guardKey{{BanIP, ip.String()}, {BanUser, username}} {
+		if key.key == "" {
+			continue
+		}
+		if e := s.entry(key.kind, key.key); e != nil {
+			e.mu.Lock()
+			e.failures = 0
+			e.mu.Unlock()
+		}
+	}
+}
+
+// Unban lifts a ban, and forgets the failures and bans of an IP or username.
+// Returns false if it wasn't banned
+func (s *AuthGuard) Unban(kind BanKind, key string) bool {
+	banned := !s.Banned(kind, key).IsZero()
+	s.entries.Delete(guardKey{kind, key})
+	return banned
+}
+
+// CurrentBans returns the current bans, ending soonest first
+func (s *AuthGuard) CurrentBans() []Ban {
+	var ret []Ban
+	now := time.Now()
+	s.entries.Range(func(item *ttlcache.Item[guardKey, *guardEntry]) bool {
+		e := item.Value()
+		e.mu.Lock()
+		if now.Before(e.until) {
+			ret = append(ret, Ban{
+				Kind:  item.Key().kind,
+				Key:   item.Key().key,
+				Until: e.until,
+				Count: e.bans,
+			})
+		}
+		e.mu.Unlock()
+		return true
+	})
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Until.Before(ret[j].Until)
+	})
+	return ret
+}
+
+// guardedCredentials fails authentication of banned usernames, without
+// checking their password
+type guardedCredentials struct {
+	CredentialStore
+	guard *AuthGuard
+}
+
+func (s guardedCredentials) Valid(user, password string) bool {
+	if !s.guard.Banned(BanUser, user).IsZero() {
+		s.guard.Refused.Add(1)
+		return false
+	}
+	return s.CredentialStore.Valid(user, password)
+}
+
+func (s guardedCredentials) Verify(ctx context.Context, info *ConnInfo, user, password string) (map[string]string, error) {
+	if !s.guard.Banned(BanUser, user).IsZero() {
+		s.guard.Refused.Add(1)
+		return nil, UserAuthFailed
+	}
+	return Verifier(s.CredentialStore).Verify(ctx, info, user, password)
+}
+
+// guardAuthenticator makes a UserPassAuthenticator fail for banned usernames
+func guardAuthenticator(a Authenticator, guard *AuthGuard) Authenticator {
+	switch a := a.(type) {
+	case UserPassAuthenticator:
+		return UserPassAuthenticator{guardedCredentials{a.Credentials, guard}}
+	case *UserPassAuthenticator:
+		return &UserPassAuthenticator{guardedCredentials{a.Credentials, guard}}
+	}
+	return a
+}
+
+// authUsername returns the username of a failed authentication, if known
+func authUsername(err error) string {
+	var uerr *UserAuthError
+	if errors.As(err, &uerr) {
+		return uerr.Username
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthGuard(t *testing.T) {
+	g := NewAuthGuard(AuthGuardConfig{MaxFailures: 3, Delay: time.Second, BanTime: time.Minute})
+	defer g.Close()
+	ip := net.ParseIP("10.0.0.1")
+
+	assert.Zero(t, g.Delay(ip))
+	g.Fail(ip, "bob")
+	assert.Equal(t, time.Second, g.Delay(ip))
+	g.Fail(ip, "bob")
+	assert.Equal(t, 2*time.Second, g.Delay(ip))
+	assert.True(t, g.Banned(BanIP, ip.String()).IsZero())
+
+	g.Fail(ip, "bob")
+	until := g.Banned(BanIP, ip.String())
+	assert.WithinDuration(t, time.Now().Add(time.Minute), until, time.Second)
+	assert.False(t, g.Banned(BanUser, "bob").IsZero())
+	assert.EqualValues(t, 2, g.TotalBans.Load())
+	assert.Len(t, g.CurrentBans(), 2)
+
+	// failures while banned don't extend the ban
+	g.Fail(ip, "bob")
+	assert.Equal(t, until, g.Banned(BanIP, ip.String()))
+
+	assert.True(t, g.Unban(BanIP, ip.String()))
+	assert.False(t, g.Unban(BanIP, ip.String()))
+	assert.True(t, g.Banned(BanIP, ip.String()).IsZero())
+	bans := g.CurrentBans()
+	assert.Len(t, bans, 1)
+	assert.Equal(t, BanUser, bans[0].Kind)
+	assert.Equal(t, "bob", bans[0].Key)
+}
+
+func TestAuthGuardBackoff(t *testing.T) {
+	g := NewAuthGuard(AuthGuardConfig{BanTime: time.Minute, MaxBanTime: 3 * time.Minute})
+	defer g.Close()
+
+	assert.Equal(t, time.Minute, g.backoff(time.Minute, 0, g.conf.MaxBanTime))
+	assert.Equal(t, 2*time.Minute, g.backoff(time.Minute, 1, g.conf.MaxBanTime))
+	assert.Equal(t, 3*time.Minute, g.backoff(time.Minute, 5, g.conf.MaxBanTime))
+}
+
+func TestAuthGuardUsername(t *testing.T) {
+	g := NewAuthGuard(AuthGuardConfig{MaxFailures: 1})
+	defer g.Close()
+	cator := guardAuthenticator(UserPassAuthenticator{StaticCredentials{"bob": "secret"}}, g)
+
+	auth := func(user, pass string) error {
+		req := bytes.NewBuffer([]byte{userAuthVersion, byte(len(user))})
+		req.WriteString(user)
+		req.WriteByte(byte(len(pass)))
+		req.WriteString(pass)
+		_, err := cator.Authenticate(req, io.Discard)
+		return err
+	}
+
+	assert.NoError(t, auth("bob", "secret"))
+	err := auth("bob", "guess")
+	assert.True(t, errors.Is(err, UserAuthFailed))
+	assert.Equal(t, "bob", authUsername(err))
+
+	g.Fail(net.ParseIP("10.0.0.1"), "bob")
+	assert.Error(t, auth("bob", "secret"), "banned usernames fail with the right password")
+	assert.EqualValues(t, 1, g.Refused.Load())
+}
+
+func TestServeConnBanned(t *testing.T) {
+	guard := NewAuthGuard(AuthGuardConfig{MaxFailures: 2, Delay: time.Millisecond})
+	defer guard.Close()
+	server, err := New(&Config{
+		Credentials: StaticCredentials{"bob": "secret"},
+		AuthGuard:   guard,
+	})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go server.Serve(l)
+
+	login := func(pass string) []byte {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+		req := []byte{socks5Version, 1, UserPassAuth, userAuthVersion, 3, 'b', 'o', 'b', byte(len(pass))}
+		conn.Write(append(req, pass...))
+		resp, _ := io.ReadAll(conn)
+		return resp
+	}
+
+	assert.Equal(t, []byte{socks5Version, UserPassAuth, userAuthVersion, authFailure}, login("guess"))
+	assert.Equal(t, []byte{socks5Version, UserPassAuth, userAuthVersion, authFailure}, login("guess"))
+	assert.Empty(t, login("secret"), "banned IPs are refused before the handshake")
+	assert.EqualValues(t, 2, guard.TotalBans.Load())
+}
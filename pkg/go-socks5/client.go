@@ -0,0 +1,555 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReplyError is the reply code of a request a server refused or failed
+type ReplyError uint8
+
+var replyMessages = map[uint8]string{
+	serverFailure:        "general server failure",
+	ruleFailure:          "connection not allowed by ruleset",
+	networkUnreachable:   "network unreachable",
+	hostUnreachable:      "host unreachable",
+	connectionRefused:    "connection refused",
+	ttlExpired:           "TTL expired",
+	commandNotSupported:  "command not supported",
+	addrTypeNotSupported: "address type not supported",
+}
+
+func (e ReplyError) Error() string {
+	if msg, ok := replyMessages[uint8(e)]; ok {
+		return "socks5: " + msg
+	}
+	return fmt.Sprintf("socks5: reply code %d", uint8(e))
+}
+
+// parseAddrSpec parses a host:port address
+func parseAddrSpec(address string) (*AddrSpec, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum < 0 || portNum > 0xFFFF {
+		return nil, fmt.Errorf("invalid port in address %q", address)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &AddrSpec{IP: ip, Port: portNum}, nil
+	}
+	return &AddrSpec{FQDN: host, Port: portNum}, nil
+}
+
+// clientHandshake negotiates the authentication with a server, offering
+// username/password authentication when user is set
+func clientHandshake(rw io.ReadWriter, user, password string) error {
+	greeting := []byte{socks5Version, 1, NoAuth}
+	if user != "" {
+		greeting = []byte{socks5Version, 2, NoAuth, UserPassAuth}
+	}
+	if _, err := rw.Write(greeting); err != nil {
+		return err
+	}
+
+	resp := []byte{0, 0}
+	if _, err := io.ReadFull(rw, resp); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("Unsupported version: %v", resp[0])
+	}
+
+	switch resp[1] {
+	case NoAuth:
+		return nil
+	case UserPassAuth:
+		if user == "" {
+			return NoSupportedAuth
+		}
+		if len(user) > 255 || len(password) > 255 {
+			return fmt.Errorf("username or password too long")
+		}
+		msg := append([]byte{userAuthVersion, byte(len(user))}, user...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if _, err := rw.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(rw, resp); err != nil {
+			return err
+		}
+		if resp[1] != authSuccess {
+			return UserAuthFailed
+		}
+		return nil
+	default:
+		return NoSupportedAuth
+	}
+}
+
+// clientRequest sends a request to a server, and returns the address of its
+// reply
+func clientRequest(rw io.ReadWriter, cmd uint8, addr *AddrSpec) (*AddrSpec, error) {
+	msg, err := appendAddrSpec([]byte{socks5Version, cmd, 0}, addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rw.Write(msg); err != nil {
+		return nil, err
+	}
+	return clientReply(rw)
+}
+
+// clientReply reads a reply of a server, and returns its address
+func clientReply(r io.Reader) (*AddrSpec, error) {
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("Unsupported version: %v", header[0])
+	}
+	bound, err := readAddrSpec(r)
+	if err != nil {
+		return nil, err
+	}
+	if header[1] != successReply {
+		return nil, ReplyError(header[1])
+	}
+	return bound, nil
+}
+
+// addrSpecOf converts the address of a target, which can be a host name
+func addrSpecOf(addr net.Addr) (*AddrSpec, error) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return &AddrSpec{IP: a.IP, Port: a.Port}, nil
+	case *net.TCPAddr:
+		return &AddrSpec{IP: a.IP, Port: a.Port}, nil
+	}
+	return parseAddrSpec(addr.String())
+}
+
+// udpAddrOf converts the address of a datagram, see fqdnAddr
+func udpAddrOf(spec *AddrSpec) net.Addr {
+	if spec.IP == nil {
+		return fqdnAddr(net.JoinHostPort(spec.FQDN, strconv.Itoa(spec.Port)))
+	}
+	return &net.UDPAddr{IP: spec.IP, Port: spec.Port}
+}
+
+// aLongTimeAgo is a deadline in the past, interrupting blocked I/O
+var aLongTimeAgo = time.Unix(1, 0)
+
+// withContext runs an exchange with a server over conn, interrupting it when
+// the context is done
+func withContext(ctx context.Context, conn net.Conn, exchange func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+
+	err := exchange()
+	close(done)
+	<-stopped
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	conn.SetDeadline(time.Time{})
+	return err
+}
+
+// Dialer connects to targets through a SOCKS5 server. It can be set as the
+// Config.Dial of another Server, chaining it to a parent proxy
+type Dialer struct {
+	// ProxyNetwork and ProxyAddress locate the server, the network defaults
+	// to "tcp"
+	ProxyNetwork string
+	ProxyAddress string
+	// User and Password, if User is set, are offered for username/password
+	// authentication
+	User     string
+	Password string
+	// Forward connects to the server, defaults to a net.Dialer
+	Forward func(ctx context.Context, network, addr string) (net.Conn, error)
+	// UDPTunnel relays datagrams over the connection to the server, see
+	// UDPTunnelCommand, rather than with UDP ASSOCIATE
+	UDPTunnel bool
+}
+
+// request connects and authenticates to the server, and sends it a request.
+// It returns the connection and the address of the reply
+func (d *Dialer) request(ctx context.Context, cmd uint8, addr *AddrSpec) (net.Conn, *AddrSpec, error) {
+	network := d.ProxyNetwork
+	if network == "" {
+		network = "tcp"
+	}
+	var conn net.Conn
+	var err error
+	if d.Forward != nil {
+		conn, err = d.Forward(ctx, network, d.ProxyAddress)
+	} else {
+		var nd net.Dialer
+		conn, err = nd.DialContext(ctx, network, d.ProxyAddress)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var bound *AddrSpec
+	err = withContext(ctx, conn, func() error {
+		if err := clientHandshake(conn, d.User, d.Password); err != nil {
+			return err
+		}
+		bound, err = clientRequest(conn, cmd, addr)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, bound, nil
+}
+
+// Dial connects to a target through the server, see DialContext
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to a target, which can be a host name resolved by the
+// server. TCP networks are relayed with CONNECT, returning the connection to
+// the server. UDP networks open an association, see ListenPacket, whose
+// datagrams are all sent to the target
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	target, err := parseAddrSpec(address)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		conn, _, err := d.request(ctx, ConnectCommand, target)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		return conn, nil
+	case "udp", "udp4", "udp6":
+		pc, err := d.ListenPacket(ctx)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		return &packetConn{PacketConn: pc, remote: udpAddrOf(target)}, nil
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+}
+
+// Binding is a BIND request waiting for a connection from a target
+type Binding struct {
+	conn net.Conn
+	// Addr is where the server listens for the connection of the target
+	Addr *AddrSpec
+}
+
+// Bind requests the server to listen for a connection from the target at
+// address, whose port may be 0. The listening address, in Binding.Addr, is
+// meant to be sent to the target by another connection, eg. the control
+// connection of FTP
+func (d *Dialer) Bind(ctx context.Context, address string) (*Binding, error) {
+	target, err := parseAddrSpec(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, bound, err := d.request(ctx, BindCommand, target)
+	if err != nil {
+		return nil, err
+	}
+	return &Binding{conn: conn, Addr: bound}, nil
+}
+
+// Accept waits for the second reply of the server, and returns the
+// connection to the server, relaying to the target, and the address of the
+// target. The binding can't be used any more
+func (b *Binding) Accept(ctx context.Context) (net.Conn, *AddrSpec, error) {
+	var peer *AddrSpec
+	err := withContext(ctx, b.conn, func() (err error) {
+		peer, err = clientReply(b.conn)
+		return err
+	})
+	if err != nil {
+		b.conn.Close()
+		return nil, nil, err
+	}
+	return b.conn, peer, nil
+}
+
+// Close cancels the binding
+func (b *Binding) Close() error {
+	return b.conn.Close()
+}
+
+// ListenPacket opens an UDP association, whose datagrams can be sent to
+// several targets, including host names resolved by the server. It ends when
+// the net.PacketConn is closed, or when the server closes the association
+func (d *Dialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if d.UDPTunnel {
+		conn, _, err := d.request(ctx, UDPTunnelCommand, nil)
+		if err != nil {
+			return nil, err
+		}
+		return newUDPTunnel(conn), nil
+	}
+
+	// the source port may be translated, leave it to the first datagram
+	conn, bound, err := d.request(ctx, AssociateCommand, &AddrSpec{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	relay := &net.UDPAddr{IP: bound.IP, Port: bound.Port}
+	if bound.IP == nil || bound.IP.IsUnspecified() {
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = tcpAddr.IP
+		} else {
+			relay.IP = net.IPv4(127, 0, 0, 1)
+		}
+	}
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	a := &associateConn{control: conn, conn: udpConn, relay: relay}
+	go a.watchControl()
+	return a, nil
+}
+
+// associateConn is a net.PacketConn sending datagrams through the relay of
+// an UDP association
+type associateConn struct {
+	control net.Conn
+	conn    *net.UDPConn
+	relay   *net.UDPAddr
+
+	rmu sync.Mutex
+	buf []byte
+}
+
+// watchControl closes the socket when the server ends the association
+func (a *associateConn) watchControl() {
+	io.Copy(io.Discard, a.control)
+	a.conn.Close()
+}
+
+// ReadFrom reads a datagram from the relay, and the target it was received
+// from. Larger datagrams than p are truncated
+func (a *associateConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	a.rmu.Lock()
+	defer a.rmu.Unlock()
+	if a.buf == nil {
+		a.buf = make([]byte, udpBufferSize)
+	}
+
+	for {
+		n, src, err := a.conn.ReadFromUDP(a.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if src.Port != a.relay.Port || !src.IP.Equal(a.relay.IP) {
+			continue
+		}
+		from, headerLen, err := readUDPHeader(a.buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(p, a.buf[headerLen:n]), udpAddrOf(from), nil
+	}
+}
+
+// WriteTo sends a datagram to a target, which can also be a host name
+func (a *associateConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	to, err := addrSpecOf(addr)
+	if err != nil {
+		return 0, err
+	}
+	datagram, err := appendAddrSpec(make([]byte, 3, 3+1+1+255+2+len(p)), to)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := a.conn.WriteToUDP(append(datagram, p...), a.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (a *associateConn) Close() error {
+	a.control.Close()
+	return a.conn.Close()
+}
+
+func (a *associateConn) LocalAddr() net.Addr {
+	return a.conn.LocalAddr()
+}
+
+func (a *associateConn) SetDeadline(deadline time.Time) error {
+	return a.conn.SetDeadline(deadline)
+}
+
+func (a *associateConn) SetReadDeadline(deadline time.Time) error {
+	return a.conn.SetReadDeadline(deadline)
+}
+
+func (a *associateConn) SetWriteDeadline(deadline time.Time) error {
+	return a.conn.SetWriteDeadline(deadline)
+}
+
+// packetConn is a net.Conn exchanging the datagrams of a net.PacketConn
+// with a single target
+type packetConn struct {
+	net.PacketConn
+	remote net.Addr
+}
+
+func (c *packetConn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+func (c *packetConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.remote)
+}
+
+func (c *packetConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// UDPTunnel is a net.PacketConn relaying datagrams over a connection to a
+// server, for networks blocking UDP, see UDPTunnelCommand
+type UDPTunnel struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	rmu sync.Mutex
+	buf []byte
+	wmu sync.Mutex
+}
+
+var _ net.PacketConn = &UDPTunnel{}
+
+// NewUDPTunnel requests an UDP tunnel over a connection to a server,
+// authenticating with user and password when user is set
+func NewUDPTunnel(conn net.Conn, user, password string) (*UDPTunnel, error) {
+	if err := clientHandshake(conn, user, password); err != nil {
+		return nil, err
+	}
+	if _, err := clientRequest(conn, UDPTunnelCommand, nil); err != nil {
+		return nil, err
+	}
+	return newUDPTunnel(conn), nil
+}
+
+func newUDPTunnel(conn net.Conn) *UDPTunnel {
+	return &UDPTunnel{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// DialUDPTunnel connects to a server, and requests an UDP tunnel, see
+// NewUDPTunnel. The context bounds the connection and the handshake
+func DialUDPTunnel(ctx context.Context, network, address, user, password string) (*UDPTunnel, error) {
+	d := Dialer{ProxyNetwork: network, ProxyAddress: address, User: user, Password: password}
+	conn, _, err := d.request(ctx, UDPTunnelCommand, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newUDPTunnel(conn), nil
+}
+
+// ReadFrom reads a datagram, and the target it was received from. Larger
+// datagrams than p are truncated
+func (t *UDPTunnel) ReadFrom(p []byte) (int, net.Addr, error) {
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+	if t.buf == nil {
+		t.buf = make([]byte, 0xFFFF)
+	}
+
+	for {
+		n, err := readUDPFrame(t.reader, t.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		from, headerLen, err := readUDPHeader(t.buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(p, t.buf[headerLen:n]), udpAddrOf(from), nil
+	}
+}
+
+// WriteTo sends a datagram to a target, which can also be a host name
+func (t *UDPTunnel) WriteTo(p []byte, addr net.Addr) (int, error) {
+	to, err := addrSpecOf(addr)
+	if err != nil {
+		return 0, err
+	}
+	header, err := appendAddrSpec([]byte{0, 0, 0}, to)
+	if err != nil {
+		return 0, err
+	}
+
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	if err := writeUDPFrame(t.conn, header, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *UDPTunnel) Close() error {
+	return t.conn.Close()
+}
+
+func (t *UDPTunnel) LocalAddr() net.Addr {
+	return t.conn.LocalAddr()
+}
+
+func (t *UDPTunnel) SetDeadline(deadline time.Time) error {
+	return t.conn.SetDeadline(deadline)
+}
+
+func (t *UDPTunnel) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+func (t *UDPTunnel) SetWriteDeadline(deadline time.Time) error {
+	return t.conn.SetWriteDeadline(deadline)
+}
+
+// fqdnAddr is the host:port address of a datagram from a host name
+type fqdnAddr string
+
+func (a fqdnAddr) Network() string {
+	return "udp"
+}
+
+func (a fqdnAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,217 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serve starts a server on a loopback port, and returns its address
+func serve(t *testing.T, conf *Config) (*Server, string) {
+	server, err := New(conf)
+	assert.NoError(t, err)
+	t.Cleanup(server.Close)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go server.Serve(l)
+	return server, l.Addr().String()
+}
+
+// echo writes a message to a connection, and reads it back
+func echo(t *testing.T, conn net.Conn, msg string) string {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write([]byte(msg))
+	assert.NoError(t, err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	return string(buf)
+}
+
+func TestDialerConnect(t *testing.T) {
+	target := echoServer(t)
+	_, addr := serve(t, &Config{
+		Credentials: StaticCredentials{"user": "pass"},
+		Resolver:    stubResolver{"echo.example": "127.0.0.1", "blocked.example": "127.0.0.1"},
+		Rules:       denyDest("blocked.example"),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	d := &Dialer{ProxyAddress: addr, User: "user", Password: "wrong"}
+	_, err := d.DialContext(ctx, "tcp", target.String())
+	assert.ErrorIs(t, err, UserAuthFailed)
+
+	d.Password = "pass"
+	conn, err := d.DialContext(ctx, "tcp", target.String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "ping", echo(t, conn, "ping"))
+
+	// host names are resolved by the server
+	port := target.AddrPort().Port()
+	conn, err = d.DialContext(ctx, "tcp", net.JoinHostPort("echo.example", strconv.Itoa(int(port))))
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "pong", echo(t, conn, "pong"))
+
+	_, err = d.DialContext(ctx, "tcp", net.JoinHostPort("blocked.example", strconv.Itoa(int(port))))
+	assert.ErrorIs(t, err, ReplyError(ruleFailure))
+	_, err = d.DialContext(ctx, "unix", "/run/socks.sock")
+	assert.Error(t, err)
+}
+
+func TestDialerContext(t *testing.T) {
+	// a server which never replies
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d := &Dialer{ProxyAddress: l.Addr().String()}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = d.DialContext(ctx, "tcp", "127.0.0.1:80")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestDialerListenPacket(t *testing.T) {
+	target := udpEchoServer(t)
+	server, addr := serve(t, &Config{})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, tunnel := range []bool{false, true} {
+		d := &Dialer{ProxyAddress: addr, UDPTunnel: tunnel}
+		pc, err := d.ListenPacket(ctx)
+		assert.NoError(t, err)
+		pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+		_, err = pc.WriteTo([]byte("ping"), target)
+		assert.NoError(t, err)
+		buf := make([]byte, 64)
+		n, from, err := pc.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "ping", string(buf[:n]))
+		assert.Equal(t, target.String(), from.String())
+
+		// a net.Conn to a single target
+		conn, err := d.DialContext(ctx, "udp", target.String())
+		assert.NoError(t, err)
+		assert.Equal(t, "pong", echo(t, conn, "pong"))
+		assert.Equal(t, target.String(), conn.RemoteAddr().String())
+
+		count := 0
+		server.RangeUDPAssociations(func(a UDPAssociation) { count++ })
+		assert.Equal(t, 2, count)
+
+		pc.Close()
+		conn.Close()
+		assert.Eventually(t, func() bool {
+			count := 0
+			server.RangeUDPAssociations(func(a UDPAssociation) { count++ })
+			return count == 0
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestDialerListenPacketClosed(t *testing.T) {
+	_, addr := serve(t, &Config{UDPIdleTimeout: 100 * time.Millisecond})
+
+	d := &Dialer{ProxyAddress: addr}
+	pc, err := d.ListenPacket(context.Background())
+	assert.NoError(t, err)
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the association ends when the server closes it
+	start := time.Now()
+	_, _, err = pc.ReadFrom(make([]byte, 16))
+	assert.ErrorIs(t, err, net.ErrClosed)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestDialerBind(t *testing.T) {
+	// the server isn't supporting BIND, a scripted one replies twice
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	requested := make(chan *AddrSpec, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.ReadFull(conn, make([]byte, 3)) // greeting
+		conn.Write([]byte{socks5Version, NoAuth})
+		req, err := NewRequest(conn)
+		if err != nil || req.Command != BindCommand {
+			return
+		}
+		requested <- req.DestAddr
+		sendReply(conn, successReply, &AddrSpec{IP: net.IPv4(10, 0, 0, 1), Port: 20000})
+		sendReply(conn, successReply, &AddrSpec{IP: net.IPv4(192, 0, 2, 1), Port: 20001})
+		conn.Write([]byte("hello"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d := &Dialer{ProxyAddress: l.Addr().String()}
+	b, err := d.Bind(ctx, "192.0.2.1:0")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:20000", b.Addr.Address())
+	assert.Equal(t, "192.0.2.1:0", (<-requested).Address())
+
+	conn, peer, err := b.Accept(ctx)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "192.0.2.1:20001", peer.Address())
+	msg, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(msg))
+}
+
+func TestDialerChain(t *testing.T) {
+	target := echoServer(t)
+	udpTarget := udpEchoServer(t)
+	parent, parentAddr := serve(t, &Config{Credentials: StaticCredentials{"child": "pass"}})
+	_, addr := serve(t, &Config{
+		Dial: (&Dialer{ProxyAddress: parentAddr, User: "child", Password: "pass"}).DialContext,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	d := &Dialer{ProxyAddress: addr}
+	conn, err := d.DialContext(ctx, "tcp", target.String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "ping", echo(t, conn, "ping"))
+
+	udpConn, err := d.DialContext(ctx, "udp", udpTarget.String())
+	assert.NoError(t, err)
+	defer udpConn.Close()
+	assert.Equal(t, "pong", echo(t, udpConn, "pong"))
+
+	// the parent relays both, for the child proxy
+	host := parent.config.Metrics.Host("127.0.0.1")
+	assert.EqualValues(t, 1, host.Commands[commandSlot(ConnectCommand)].Load())
+	assert.EqualValues(t, 1, host.Commands[commandSlot(AssociateCommand)].Load())
+}
@@ -38,3 +38,15 @@ func (s *ClientFilterCIDR) Allowed(ip net.IP) bool {
 	}
 	return false
 }
+
+// ClientFilterChain allows a client when all its filters allow it
+type ClientFilterChain []ClientFilter
+
+func (s ClientFilterChain) Allowed(ip net.IP) bool {
+	for _, filter := range s {
+		if !filter.Allowed(ip) {
+			return false
+		}
+	}
+	return true
+}
@@ -58,48 +58,44 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 	return d, nil
 }
 
-// sendReply is used to send a reply message
-func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
-	// Format the address
-	var addrType uint8
-	var addrBody []byte
-	var addrPort uint16
+// appendAddrSpec appends the type, address and port of addr, as in requests,
+// replies and UDP headers
+func appendAddrSpec(b []byte, addr *AddrSpec) ([]byte, error) {
 	switch {
 	case addr == nil:
-		addrType = ipv4Address
-		addrBody = []byte{0, 0, 0, 0}
-		addrPort = 0
+		b = append(b, ipv4Address, 0, 0, 0, 0)
+		return append(b, 0, 0), nil
 
 	case addr.FQDN != "":
-		addrType = fqdnAddress
-		addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
-		addrPort = uint16(addr.Port)
+		if len(addr.FQDN) > 255 {
+			return nil, fmt.Errorf("Failed to format address: %v", addr)
+		}
+		b = append(b, fqdnAddress, byte(len(addr.FQDN)))
+		b = append(b, addr.FQDN...)
 
 	case addr.IP.To4() != nil:
-		addrType = ipv4Address
-		addrBody = []byte(addr.IP.To4())
-		addrPort = uint16(addr.Port)
+		b = append(b, ipv4Address)
+		b = append(b, addr.IP.To4()...)
 
 	case addr.IP.To16() != nil:
-		addrType = ipv6Address
-		addrBody = []byte(addr.IP.To16())
-		addrPort = uint16(addr.Port)
+		b = append(b, ipv6Address)
+		b = append(b, addr.IP.To16()...)
 
 	default:
-		return fmt.Errorf("Failed to format address: %v", addr)
+		return nil, fmt.Errorf("Failed to format address: %v", addr)
 	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port)), nil
+}
 
+// sendReply is used to send a reply message
+func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
 	// Format the message
-	msg := make([]byte, 6+len(addrBody))
-	msg[0] = socks5Version
-	msg[1] = resp
-	msg[2] = 0 // Reserved
-	msg[3] = addrType
-	copy(msg[4:], addrBody)
-	msg[4+len(addrBody)] = byte(addrPort >> 8)
-	msg[4+len(addrBody)+1] = byte(addrPort & 0xff)
+	msg, err := appendAddrSpec([]byte{socks5Version, resp, 0}, addr)
+	if err != nil {
+		return err
+	}
 
 	// Send the message
-	_, err := w.Write(msg)
+	_, err = w.Write(msg)
 	return err
 }
@@ -0,0 +1,29 @@
+//go:build unix
+
+package socks5
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// cpuUsage measures the CPU time of the process, user and system
+type cpuUsage struct {
+	start time.Duration
+}
+
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func startCPUUsage() cpuUsage {
+	return cpuUsage{cpuTime()}
+}
+
+// report adds the CPU time per operation to the benchmark results
+func (u cpuUsage) report(b *testing.B) {
+	b.ReportMetric(float64(cpuTime()-u.start)/float64(b.N), "cpu-ns/op")
+}
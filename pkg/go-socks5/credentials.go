@@ -1,5 +1,7 @@
 package socks5
 
+import "context"
+
 // CredentialStore is used to support user/pass authentication
 type CredentialStore interface {
 	Valid(user, password string) bool
@@ -15,3 +17,32 @@ func (s StaticCredentials) Valid(user, password string) bool {
 	}
 	return password == pass
 }
+
+// CredentialVerifier is a CredentialStore which is given the client
+// connection info, and returns attributes of the user which are merged into
+// the AuthContext Payload.
+// Verify returns an error matching UserAuthFailed for invalid credentials,
+// and other errors when they couldn't be checked.
+type CredentialVerifier interface {
+	CredentialStore
+	Verify(ctx context.Context, info *ConnInfo, user, password string) (map[string]string, error)
+}
+
+// Verifier adapts a CredentialStore into a CredentialVerifier, if it isn't one
+func Verifier(store CredentialStore) CredentialVerifier {
+	if v, ok := store.(CredentialVerifier); ok {
+		return v
+	}
+	return storeVerifier{store}
+}
+
+type storeVerifier struct {
+	CredentialStore
+}
+
+func (s storeVerifier) Verify(ctx context.Context, info *ConnInfo, user, password string) (map[string]string, error) {
+	if !s.Valid(user, password) {
+		return nil, UserAuthFailed
+	}
+	return nil, nil
+}
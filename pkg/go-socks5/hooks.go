@@ -0,0 +1,155 @@
+package socks5
+
+import (
+	"context"
+	"net"
+)
+
+// Direction of a transfer, relative to the client
+type Direction uint8
+
+const (
+	// DirectionTx is data sent by the client towards the target
+	DirectionTx Direction = iota
+	// DirectionRx is data received from the target and sent to the client
+	DirectionRx
+)
+
+func (d Direction) String() string {
+	if d == DirectionRx {
+		return "rx"
+	}
+	return "tx"
+}
+
+// Hook observes the lifecycle of a connection, and can wrap the
+// client and target connections for inspection or accounting.
+// Embed NopHook to only implement the callbacks of interest.
+//
+// Callbacks may be invoked concurrently, and must not block.
+type Hook interface {
+	// WrapClientConn is invoked as soon as a connection is accepted, before
+	// any data is read. The returned connection is used for the rest of the session.
+	WrapClientConn(conn net.Conn) net.Conn
+	// OnAccept is invoked once the client passed the Filter
+	OnAccept(conn net.Conn)
+	// OnAuthSuccess is invoked after a successful authentication
+	OnAuthSuccess(conn net.Conn, auth *AuthContext)
+	// OnAuthFailure is invoked when authentication failed; the connection is closed afterwards
+	OnAuthFailure(conn net.Conn, err error)
+	// OnRequest is invoked once a request was parsed, resolved and rewritten
+	OnRequest(ctx context.Context, req *Request)
+	// OnRuleDecision is invoked with the decision of the Rules for a request
+	OnRuleDecision(ctx context.Context, req *Request, d Decision)
+	// OnDialStart is invoked before dialing out to a target
+	OnDialStart(ctx context.Context, req *Request, network, addr string)
+	// OnDialFinish is invoked with the result of a dial
+	OnDialFinish(ctx context.Context, req *Request, target net.Conn, err error)
+	// WrapTargetConn is invoked after a successful dial. The returned
+	// connection is used to talk to the target.
+	WrapTargetConn(ctx context.Context, req *Request, target net.Conn) net.Conn
+	// OnTransfer is invoked every time n bytes were relayed in the given direction
+	OnTransfer(ctx context.Context, req *Request, dir Direction, n int)
+	// OnClose is invoked when a request finished, with the error it finished with (if any)
+	OnClose(ctx context.Context, req *Request, err error)
+}
+
+// NopHook implements Hook, and does nothing
+type NopHook struct{}
+
+func (NopHook) WrapClientConn(conn net.Conn) net.Conn {
+	return conn
+}
+
+func (NopHook) OnAccept(conn net.Conn) {}
+
+func (NopHook) OnAuthSuccess(conn net.Conn, auth *AuthContext) {}
+
+func (NopHook) OnAuthFailure(conn net.Conn, err error) {}
+
+func (NopHook) OnRequest(ctx context.Context, req *Request) {}
+
+func (NopHook) OnRuleDecision(ctx context.Context, req *Request, d Decision) {}
+
+func (NopHook) OnDialStart(ctx context.Context, req *Request, network, addr string) {}
+
+func (NopHook) OnDialFinish(ctx context.Context, req *Request, target net.Conn, err error) {}
+
+func (NopHook) WrapTargetConn(ctx context.Context, req *Request, target net.Conn) net.Conn {
+	return target
+}
+
+func (NopHook) OnTransfer(ctx context.Context, req *Request, dir Direction, n int) {}
+
+func (NopHook) OnClose(ctx context.Context, req *Request, err error) {}
+
+// hookChain invokes each hook in order
+type hookChain []Hook
+
+func (s hookChain) WrapClientConn(conn net.Conn) net.Conn {
+	for _, h := range s {
+		conn = h.WrapClientConn(conn)
+	}
+	return conn
+}
+
+func (s hookChain) OnAccept(conn net.Conn) {
+	for _, h := range s {
+		h.OnAccept(conn)
+	}
+}
+
+func (s hookChain) OnAuthSuccess(conn net.Conn, auth *AuthContext) {
+	for _, h := range s {
+		h.OnAuthSuccess(conn, auth)
+	}
+}
+
+func (s hookChain) OnAuthFailure(conn net.Conn, err error) {
+	for _, h := range s {
+		h.OnAuthFailure(conn, err)
+	}
+}
+
+func (s hookChain) OnRequest(ctx context.Context, req *Request) {
+	for _, h := range s {
+		h.OnRequest(ctx, req)
+	}
+}
+
+func (s hookChain) OnRuleDecision(ctx context.Context, req *Request, d Decision) {
+	for _, h := range s {
+		h.OnRuleDecision(ctx, req, d)
+	}
+}
+
+func (s hookChain) OnDialStart(ctx context.Context, req *Request, network, addr string) {
+	for _, h := range s {
+		h.OnDialStart(ctx, req, network, addr)
+	}
+}
+
+func (s hookChain) OnDialFinish(ctx context.Context, req *Request, target net.Conn, err error) {
+	for _, h := range s {
+		h.OnDialFinish(ctx, req, target, err)
+	}
+}
+
+func (s hookChain) WrapTargetConn(ctx context.Context, req *Request, target net.Conn) net.Conn {
+	for _, h := range s {
+		target = h.WrapTargetConn(ctx, req, target)
+	}
+	return target
+}
+
+func (s hookChain) OnTransfer(ctx context.Context, req *Request, dir Direction, n int) {
+	for _, h := range s {
+		h.OnTransfer(ctx, req, dir, n)
+	}
+}
+
+func (s hookChain) OnClose(ctx context.Context, req *Request, err error) {
+	for _, h := range s {
+		h.OnClose(ctx, req, err)
+	}
+}
@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordHook records the callbacks it receives, in order. Consecutive
+// transfers are recorded once.
+type recordHook struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *recordHook) record(event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if n := len(h.events); n > 0 && h.events[n-1] == event && event == "transfer" {
+		return
+	}
+	h.events = append(h.events, event)
+}
+
+func (h *recordHook) recorded() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.events...)
+}
+
+func (h *recordHook) WrapClientConn(conn net.Conn) net.Conn {
+	h.record("wrap-client")
+	return conn
+}
+
+func (h *recordHook) OnAccept(conn net.Conn) { h.record("accept") }
+
+func (h *recordHook) OnAuthSuccess(conn net.Conn, auth *AuthContext) { h.record("auth-success") }
+
+func (h *recordHook) OnAuthFailure(conn net.Conn, err error) { h.record("auth-failure") }
+
+func (h *recordHook) OnRequest(ctx context.Context, req *Request) { h.record("request") }
+
+func (h *recordHook) OnRuleDecision(ctx context.Context, req *Request, d Decision) {
+	h.record("decision:" + d.Verdict.String())
+}
+
+func (h *recordHook) OnDialStart(ctx context.Context, req *Request, network, addr string) {
+	h.record("dial-start")
+}
+
+func (h *recordHook) OnDialFinish(ctx context.Context, req *Request, target net.Conn, err error) {
+	h.record("dial-finish")
+}
+
+func (h *recordHook) WrapTargetConn(ctx context.Context, req *Request, target net.Conn) net.Conn {
+	h.record("wrap-target")
+	return target
+}
+
+func (h *recordHook) OnTransfer(ctx context.Context, req *Request, dir Direction, n int) {
+	h.record("transfer")
+}
+
+func (h *recordHook) OnClose(ctx context.Context, req *Request, err error) { h.record("close") }
+
+func TestHookOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     *Config
+		user     string
+		password string
+		target   func(h *harness) string
+		want     []string
+	}{
+		{
+			name:   "connect",
+			conf:   &Config{},
+			target: func(h *harness) string { return h.tcpEcho.String() },
+			want: []string{
+				"wrap-client", "accept", "auth-success", "request", "decision:allow",
+				"dial-start", "dial-finish", "wrap-target", "transfer", "close",
+			},
+		},
+		{
+			name:   "denied",
+			conf:   &Config{Rules: denyDest("blocked.test")},
+			target: func(h *harness) string { return h.echoAddress("blocked.test") },
+			want:   []string{"wrap-client", "accept", "auth-success", "request", "decision:deny", "close"},
+		},
+		{
+			name:     "auth failure",
+			conf:     &Config{Credentials: StaticCredentials{"alice": "secret"}},
+			user:     "alice",
+			password: "wrong",
+			target:   func(h *harness) string { return h.tcpEcho.String() },
+			want:     []string{"wrap-client", "accept", "auth-failure"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := &recordHook{}
+			tt.conf.Hooks = []Hook{hook}
+			h := newHarness(t, tt.conf)
+
+			h.connect(h.dialer(tt.user, tt.password), tt.target(h), "hello")
+			h.idle()
+			assert.Eventually(t, func() bool {
+				return len(hook.recorded()) == len(tt.want)
+			}, 2*time.Second, 10*time.Millisecond)
+			assert.Equal(t, tt.want, hook.recorded())
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// harness runs a Server on loopback, along with TCP and UDP echo targets
+// and a stub resolver, for end-to-end tests through a Dialer
+type harness struct {
+	t       *testing.T
+	server  *Server
+	addr    string
+	metrics *MemoryMetrics
+
+	tcpEcho *net.TCPAddr
+	udpEcho *net.UDPAddr
+}
+
+// newHarness starts a server with conf. Its Metrics default to a private
+// MemoryMetrics, and its Resolver to a stub resolving the ".test" names of
+// the harness to loopback
+func newHarness(t *testing.T, conf *Config) *harness {
+	h := &harness{
+		t:       t,
+		tcpEcho: echoServer(t),
+		udpEcho: udpEchoServer(t),
+	}
+	if conf.Metrics == nil {
+		h.metrics = NewMemoryMetrics(MemoryMetricsConfig{})
+		t.Cleanup(h.metrics.Close)
+		conf.Metrics = h.metrics
+	}
+	if conf.Resolver == nil {
+		conf.Resolver = stubResolver{"echo.test": "127.0.0.1", "blocked.test": "127.0.0.1"}
+	}
+	if conf.Logger == nil {
+		conf.Logger = logrus.New()
+		conf.Logger.SetOutput(io.Discard)
+	}
+	h.server, h.addr = serve(t, conf)
+	return h
+}
+
+// dialer returns a Dialer to the server, authenticating as user
+func (h *harness) dialer(user, password string) *Dialer {
+	return &Dialer{ProxyAddress: h.addr, User: user, Password: password}
+}
+
+// echoAddress is the address of the TCP echo target under a host name
+func (h *harness) echoAddress(host string) string {
+	return net.JoinHostPort(host, strconv.Itoa(h.tcpEcho.Port))
+}
+
+// connect dials a target through the server, and checks it echoes
+func (h *harness) connect(d *Dialer, address, msg string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	assert.Equal(h.t, msg, echo(h.t, conn, msg))
+	return nil
+}
+
+// idle waits for the connections of the server to be closed
+func (h *harness) idle() {
+	assert.Eventually(h.t, func() bool {
+		return h.server.listener.Active.Load() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestIntegrationConnect(t *testing.T) {
+	for _, disableSplice := range []bool{false, true} {
+		h := newHarness(t, &Config{DetailedMetrics: true, DisableSplice: disableSplice})
+		d := h.dialer("", "")
+
+		assert.NoError(t, h.connect(d, h.tcpEcho.String(), "hello"))
+		assert.NoError(t, h.connect(d, h.echoAddress("echo.test"), "hello world"))
+		h.idle()
+
+		// unknown names are unreachable, closed ports refused
+		assert.ErrorIs(t, h.connect(d, h.echoAddress("unknown.test"), ""), ReplyError(hostUnreachable))
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		l.Close()
+		assert.ErrorIs(t, h.connect(d, l.Addr().String(), ""), ReplyError(connectionRefused))
+
+		// failed resolutions aren't counted as requests
+		host := h.metrics.Host("127.0.0.1")
+		assert.EqualValues(t, 3, host.Commands[commandSlot(ConnectCommand)].Load())
+		assert.EqualValues(t, 0, host.Active.Load())
+		assert.EqualValues(t, 16, host.Tx.Load())
+		assert.EqualValues(t, 16, host.Rx.Load())
+		listener := h.server.listener
+		assert.EqualValues(t, 4, listener.Accepted.Load())
+		assert.EqualValues(t, 16, listener.Tx.Load())
+		assert.EqualValues(t, 16, listener.Rx.Load())
+
+		// targets are counted by name, or by address
+		targets := map[string]*NetMetrics{}
+		h.server.RangeTargetMetrics(func(target string, m *NetMetrics) {
+			targets[target] = m
+		})
+		assert.EqualValues(t, 5, targets["127.0.0.1"].Tx.Load())
+		assert.EqualValues(t, 11, targets["echo.test"].Rx.Load())
+		assert.Equal(t, "127.0.0.1", targets["echo.test"].LastIP.Load().(net.IP).String())
+		assert.EqualValues(t, 0, targets["echo.test"].Active.Load())
+	}
+}
+
+func TestIntegrationAuth(t *testing.T) {
+	h := newHarness(t, &Config{Credentials: StaticCredentials{"alice": "secret"}})
+
+	assert.ErrorIs(t, h.connect(h.dialer("alice", "wrong"), h.tcpEcho.String(), ""), UserAuthFailed)
+	assert.ErrorIs(t, h.connect(h.dialer("bob", "secret"), h.tcpEcho.String(), ""), UserAuthFailed)
+	assert.ErrorIs(t, h.connect(h.dialer("", ""), h.tcpEcho.String(), ""), NoSupportedAuth)
+	assert.NoError(t, h.connect(h.dialer("alice", "secret"), h.tcpEcho.String(), "hello"))
+
+	listener := h.server.listener
+	assert.EqualValues(t, 4, listener.Accepted.Load())
+	assert.EqualValues(t, 3, listener.AuthFailures.Load())
+	assert.EqualValues(t, 1, h.metrics.Host("127.0.0.1").Commands[commandSlot(ConnectCommand)].Load())
+}
+
+func TestIntegrationRules(t *testing.T) {
+	h := newHarness(t, &Config{
+		Rules: &FirstMatch{
+			Rules: []Rule{
+				Named("blocked", denyDest("blocked.test")),
+				Named("udp-port", denyDatagramPort(9)),
+			},
+			Default: VerdictAllow,
+		},
+	})
+	d := h.dialer("", "")
+
+	assert.ErrorIs(t, h.connect(d, h.echoAddress("blocked.test"), ""), ReplyError(ruleFailure))
+	assert.NoError(t, h.connect(d, h.echoAddress("echo.test"), "hello"))
+
+	// datagrams to blocked targets are dropped, and others relayed
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pc, err := d.ListenPacket(ctx)
+	assert.NoError(t, err)
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = pc.WriteTo([]byte("blocked"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	assert.NoError(t, err)
+	_, err = pc.WriteTo([]byte("ping"), h.udpEcho)
+	assert.NoError(t, err)
+	buf := make([]byte, 16)
+	n, _, err := pc.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf[:n]))
+
+	rules := map[string]*RuleMetrics{}
+	h.server.RangeRuleMetrics(func(name string, m *RuleMetrics) {
+		rules[name] = m
+	})
+	assert.EqualValues(t, 1, rules["blocked"].Denied.Load())
+	assert.EqualValues(t, 1, rules["udp-port"].Denied.Load())
+	// the connection, the association and its datagram target
+	assert.EqualValues(t, 3, rules["default"].Allowed.Load())
+
+	var associations []UDPAssociation
+	h.server.RangeUDPAssociations(func(a UDPAssociation) {
+		associations = append(associations, a)
+	})
+	assert.Len(t, associations, 1)
+	assert.EqualValues(t, 1, associations[0].Metrics.Drops.Load())
+}
+
+// rewriteTo sends the connections to a host name to another address
+type rewriteTo struct {
+	from string
+	to   *AddrSpec
+}
+
+func (r rewriteTo) Rewrite(ctx context.Context, req *Request) *AddrSpec {
+	if req.DestAddr.FQDN == r.from {
+		return r.to
+	}
+	return req.DestAddr
+}
+
+func TestIntegrationRewrite(t *testing.T) {
+	to := &AddrSpec{}
+	h := newHarness(t, &Config{
+		Resolver:        stubResolver{"moved.test": "192.0.2.1"},
+		Rewriter:        rewriteTo{"moved.test", to},
+		DetailedMetrics: true,
+	})
+	*to = AddrSpec{IP: h.tcpEcho.IP, Port: h.tcpEcho.Port}
+
+	assert.NoError(t, h.connect(h.dialer("", ""), "moved.test:1", "hello"))
+	h.idle()
+
+	// the metrics count the requested destination
+	targets := map[string]*NetMetrics{}
+	h.server.RangeTargetMetrics(func(target string, m *NetMetrics) {
+		targets[target] = m
+	})
+	assert.Len(t, targets, 1)
+	assert.EqualValues(t, 5, targets["moved.test"].Tx.Load())
+}
+
+func TestIntegrationFilter(t *testing.T) {
+	filter, err := NewCidrSet("10.0.0.0/8")
+	assert.NoError(t, err)
+	h := newHarness(t, &Config{Filter: filter})
+
+	// refused clients are disconnected before the handshake
+	assert.Error(t, h.connect(h.dialer("", ""), h.tcpEcho.String(), ""))
+	assert.EqualValues(t, 1, h.server.listener.Refused.Load())
+	assert.EqualValues(t, 0, h.server.listener.Accepted.Load())
+
+	filter, err = NewCidrSet("127.0.0.0/8")
+	assert.NoError(t, err)
+	h = newHarness(t, &Config{Filter: filter})
+	assert.NoError(t, h.connect(h.dialer("", ""), h.tcpEcho.String(), "hello"))
+	assert.EqualValues(t, 0, h.server.listener.Refused.Load())
+}
+
+func TestIntegrationAssociate(t *testing.T) {
+	h := newHarness(t, &Config{DetailedMetrics: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pc, err := h.dialer("", "").ListenPacket(ctx)
+	assert.NoError(t, err)
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, 16)
+	for _, msg := range []string{"one", "two", "three"} {
+		_, err = pc.WriteTo([]byte(msg), h.udpEcho)
+		assert.NoError(t, err)
+		n, from, err := pc.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, string(buf[:n]))
+		assert.Equal(t, h.udpEcho.String(), from.String())
+	}
+
+	host := h.metrics.Host("127.0.0.1")
+	assert.EqualValues(t, 1, host.Commands[commandSlot(AssociateCommand)].Load())
+	assert.EqualValues(t, 1, host.ActiveUDP.Load())
+	assert.EqualValues(t, 11, host.Tx.Load())
+	assert.EqualValues(t, 11, host.Rx.Load())
+
+	var target *UDPMetrics
+	h.server.RangeUDPTargetMetrics(func(name string, m *UDPMetrics) {
+		target = m
+	})
+	assert.EqualValues(t, 3, target.TxPackets.Load())
+	assert.EqualValues(t, 3, target.RxPackets.Load())
+	assert.EqualValues(t, 1, target.Active.Load())
+
+	// closing the association releases its target
+	pc.Close()
+	assert.Eventually(t, func() bool {
+		return host.ActiveUDP.Load() == 0 && target.Active.Load() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
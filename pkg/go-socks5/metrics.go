@@ -0,0 +1,324 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+type NetMetrics struct {
+	Active atomic.Int64
+	Rx, Tx atomic.Int64
+	LastIP atomic.Value // net.IP the target last resolved to, unset for hosts
+}
+
+// HostCommands are the commands counted in HostMetrics.Commands, by slot.
+// Unknown commands are counted in slot 0
+var HostCommands = [...]uint8{0, ConnectCommand, BindCommand, AssociateCommand, ResolveCommand, ResolvePTRCommand}
+
+// commandSlot returns the slot of a command in HostMetrics.Commands
+func commandSlot(cmd uint8) int {
+	for i, c := range HostCommands {
+		if c == cmd {
+			return i
+		}
+	}
+	return 0
+}
+
+type HostMetrics struct {
+	NetMetrics
+	Commands  [len(HostCommands)]atomic.Int64 // see HostCommands
+	ActiveUDP atomic.Int64
+	LastSeen  atomic.Value
+}
+
+// UDPMetrics counts the datagrams relayed to and from UDP targets
+type UDPMetrics struct {
+	// Active counts the associations with a socket to the target
+	Active               atomic.Int64
+	Rx, Tx               atomic.Int64
+	RxPackets, TxPackets atomic.Int64
+	// Drops counts the datagrams not relayed, being malformed, from an
+	// unexpected source or to a target blocked by the rules
+	Drops atomic.Int64
+	// Errors counts the failed dials, reads and writes
+	Errors atomic.Int64
+}
+
+// RuleMetrics counts the decisions made by a rule
+type RuleMetrics struct {
+	Allowed, Denied atomic.Int64
+}
+
+// ListenerMetrics counts the connections of a Server, see Config.Name
+type ListenerMetrics struct {
+	NetMetrics
+	// Accepted counts the connections which passed the Filter and bans
+	Accepted atomic.Int64
+	// Refused counts the connections refused by the Filter or bans
+	Refused atomic.Int64
+	// AuthFailures counts the failed authentications
+	AuthFailures atomic.Int64
+}
+
+// MetricsSink stores the built-in metrics of a Server.
+// Implementations return the same instance for the same key until it
+// expires, and may be shared between servers.
+type MetricsSink interface {
+	// Host returns the metrics of a client host
+	Host(host string) *HostMetrics
+	// Target returns the metrics of a destination, or nil if it isn't tracked
+	Target(target string) *NetMetrics
+	// UDPTarget returns the metrics of a destination of datagrams, or nil
+	// if it isn't tracked
+	UDPTarget(target string) *UDPMetrics
+	// Rule returns the metrics of a named rule
+	Rule(name string) *RuleMetrics
+	// Listener returns the metrics of a named Server
+	Listener(name string) *ListenerMetrics
+	RangeHosts(f func(host string, m *HostMetrics))
+	RangeTargets(f func(target string, m *NetMetrics))
+	RangeUDPTargets(f func(target string, m *UDPMetrics))
+	RangeRules(f func(name string, m *RuleMetrics))
+	RangeListeners(f func(name string, m *ListenerMetrics))
+}
+
+// MemoryMetricsConfig configures a MemoryMetrics
+type MemoryMetricsConfig struct {
+	// HostTTL is how long a host is kept after last use. Defaults to 24h
+	HostTTL time.Duration
+	// TargetTTL is how long a target is kept after last use. Defaults to 30m
+	TargetTTL time.Duration
+	// MaxTargets caps the number of tracked targets, and of UDP targets,
+	// the least recently used being evicted first. 0 is unlimited
+	MaxTargets uint64
+}
+
+// MemoryMetrics is a MetricsSink which keeps metrics in memory, until they expire
+type MemoryMetrics struct {
+	hosts     *ttlcache.Cache[string, *HostMetrics]
+	targets   *ttlcache.Cache[string, *NetMetrics]
+	udp       *ttlcache.Cache[string, *UDPMetrics]
+	rules     *xsync.MapOf[string, *RuleMetrics]
+	listeners *xsync.MapOf[string, *ListenerMetrics]
+}
+
+var _ MetricsSink = &MemoryMetrics{}
+
+// NewMemoryMetrics creates a MemoryMetrics, and starts its expiration routines
+func NewMemoryMetrics(conf MemoryMetricsConfig) *MemoryMetrics {
+	if conf.HostTTL <= 0 {
+		conf.HostTTL = 24 * time.Hour
+	}
+	if conf.TargetTTL <= 0 {
+		conf.TargetTTL = 30 * time.Minute
+	}
+
+	m := &MemoryMetrics{
+		hosts: ttlcache.New[string, *HostMetrics](
+			ttlcache.WithTTL[string, *HostMetrics](conf.HostTTL),
+			ttlcache.WithLoader[string, *HostMetrics](ttlcache.LoaderFunc[string, *HostMetrics](func(c *ttlcache.Cache[string, *HostMetrics], key string) *ttlcache.Item[string, *HostMetrics] {
+				item := c.Set(key, &HostMetrics{}, ttlcache.DefaultTTL)
+				return item
+			})),
+		),
+		targets:   newTargetCache[NetMetrics](conf),
+		udp:       newTargetCache[UDPMetrics](conf),
+		rules:     xsync.NewMapOf[string, *RuleMetrics](),
+		listeners: xsync.NewMapOf[string, *ListenerMetrics](),
+	}
+
+	go m.hosts.Start()
+	go m.targets.Start()
+	go m.udp.Start()
+
+	return m
+}
+
+// newTargetCache creates the cache of the metrics of targets, which loads
+// missing keys
+func newTargetCache[T any](conf MemoryMetricsConfig) *ttlcache.Cache[string, *T] {
+	opts := []ttlcache.Option[string, *T]{
+		ttlcache.WithTTL[string, *T](conf.TargetTTL),
+		ttlcache.WithLoader[string, *T](ttlcache.LoaderFunc[string, *T](func(c *ttlcache.Cache[string, *T], key string) *ttlcache.Item[string, *T] {
+			item := c.Set(key, new(T), ttlcache.DefaultTTL)
+			return item
+		})),
+	}
+	if conf.MaxTargets > 0 {
+		opts = append(opts, ttlcache.WithCapacity[string, *T](conf.MaxTargets))
+	}
+	return ttlcache.New[string, *T](opts...)
+}
+
+func (s *MemoryMetrics) Host(host string) *HostMetrics {
+	return s.hosts.Get(host).Value()
+}
+
+func (s *MemoryMetrics) Target(target string) *NetMetrics {
+	return s.targets.Get(target).Value()
+}
+
+func (s *MemoryMetrics) UDPTarget(target string) *UDPMetrics {
+	return s.udp.Get(target).Value()
+}
+
+func (s *MemoryMetrics) Rule(name string) *RuleMetrics {
+	m, _ := s.rules.LoadOrCompute(name, func() *RuleMetrics {
+		return &RuleMetrics{}
+	})
+	return m
+}
+
+func (s *MemoryMetrics) Listener(name string) *ListenerMetrics {
+	m, _ := s.listeners.LoadOrCompute(name, func() *ListenerMetrics {
+		return &ListenerMetrics{}
+	})
+	return m
+}
+
+func (s *MemoryMetrics) RangeHosts(f func(host string, m *HostMetrics)) {
+	s.hosts.Range(func(item *ttlcache.Item[string, *HostMetrics]) bool {
+		f(item.Key(), item.Value())
+		return true
+	})
+}
+
+func (s *MemoryMetrics) RangeTargets(f func(target string, m *NetMetrics)) {
+	s.targets.Range(func(item *ttlcache.Item[string, *NetMetrics]) bool {
+		f(item.Key(), item.Value())
+		return true
+	})
+}
+
+func (s *MemoryMetrics) RangeUDPTargets(f func(target string, m *UDPMetrics)) {
+	s.udp.Range(func(item *ttlcache.Item[string, *UDPMetrics]) bool {
+		f(item.Key(), item.Value())
+		return true
+	})
+}
+
+func (s *MemoryMetrics) RangeRules(f func(name string, m *RuleMetrics)) {
+	s.rules.Range(func(key string, value *RuleMetrics) bool {
+		f(key, value)
+		return true
+	})
+}
+
+func (s *MemoryMetrics) RangeListeners(f func(name string, m *ListenerMetrics)) {
+	s.listeners.Range(func(key string, value *ListenerMetrics) bool {
+		f(key, value)
+		return true
+	})
+}
+
+// Close stops the expiration routines
+func (s *MemoryMetrics) Close() {
+	s.hosts.Stop()
+	s.targets.Stop()
+	s.udp.Stop()
+}
+
+// metricsHook records the built-in host and target metrics into the MetricsSink
+type metricsHook struct {
+	NopHook
+	server *Server
+}
+
+func (s *metricsHook) OnAccept(conn net.Conn) {
+	s.server.listener.Accepted.Add(1)
+}
+
+func (s *metricsHook) OnAuthFailure(conn net.Conn, err error) {
+	s.server.listener.AuthFailures.Add(1)
+}
+
+func (s *metricsHook) OnRequest(ctx context.Context, req *Request) {
+	host := s.server.config.Metrics.Host(req.RemoteAddr.IP.String())
+	host.Commands[commandSlot(req.Command)].Add(1)
+	host.LastSeen.Store(time.Now())
+	req.hostMetrics = host
+
+	if req.Command == ConnectCommand {
+		host.Active.Add(1)
+		s.server.listener.Active.Add(1)
+	}
+}
+
+func (s *metricsHook) OnRuleDecision(ctx context.Context, req *Request, d Decision) {
+	if d.Rule != "" {
+		rule := s.server.config.Metrics.Rule(d.Rule)
+		if d.Verdict == VerdictDeny {
+			rule.Denied.Add(1)
+		} else {
+			rule.Allowed.Add(1)
+		}
+	}
+
+	if d.Verdict != VerdictAllow || req.Datagram {
+		return
+	}
+	switch req.Command {
+	case ConnectCommand:
+		if !s.server.config.DetailedMetrics {
+			return
+		}
+		target := s.server.config.Metrics.Target(req.DestAddr.FqdnOrIP())
+		if target == req.targetMetrics {
+			return
+		}
+		// evaluated again with a sniffed domain
+		if req.targetMetrics != nil {
+			req.targetMetrics.Active.Add(-1)
+			req.targetMetrics = nil
+		}
+		if target != nil {
+			target.Active.Add(1)
+			if req.DestAddr.IP != nil {
+				target.LastIP.Store(req.DestAddr.IP)
+			}
+			req.targetMetrics = target
+		}
+	case AssociateCommand:
+		req.hostMetrics.ActiveUDP.Add(1)
+		req.udpActive = true
+	}
+}
+
+func (s *metricsHook) OnTransfer(ctx context.Context, req *Request, dir Direction, n int) {
+	var host, target *NetMetrics = &req.hostMetrics.NetMetrics, req.targetMetrics
+	listener := &s.server.listener.NetMetrics
+	if dir == DirectionRx {
+		host.Rx.Add(int64(n))
+		listener.Rx.Add(int64(n))
+		if target != nil {
+			target.Rx.Add(int64(n))
+		}
+	} else {
+		host.Tx.Add(int64(n))
+		listener.Tx.Add(int64(n))
+		if target != nil {
+			target.Tx.Add(int64(n))
+		}
+	}
+}
+
+func (s *metricsHook) OnClose(ctx context.Context, req *Request, err error) {
+	switch req.Command {
+	case ConnectCommand:
+		req.hostMetrics.Active.Add(-1)
+		s.server.listener.Active.Add(-1)
+		if req.targetMetrics != nil {
+			req.targetMetrics.Active.Add(-1)
+		}
+	case AssociateCommand:
+		if req.udpActive {
+			req.hostMetrics.ActiveUDP.Add(-1)
+		}
+	}
+}
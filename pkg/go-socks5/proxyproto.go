@@ -0,0 +1,298 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV2Signature starts PROXY protocol v2 headers
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 TLV types sent to targets, see Decision.ProxyHeader
+const (
+	// ProxyTLVAuthority is the requested domain of the target, if any
+	ProxyTLVAuthority = 0x02
+	// ProxyTLVUsername is the authenticated username of the client, in the
+	// range reserved for custom types
+	ProxyTLVUsername = 0xE0
+)
+
+// ProxyProtocolListener accepts connections from load balancers sending a
+// PROXY protocol v1 or v2 header, the client address it carries being the
+// RemoteAddr of the connection. Connections from trusted peers without a
+// header, eg. health checks, keep their address.
+//
+// The header is read on the first Read or RemoteAddr call, so that a slow
+// peer doesn't block Accept. Put it beneath any TLS listener.
+type ProxyProtocolListener struct {
+	net.Listener
+	// Trusted are the peers allowed to send headers. Connections from
+	// others sending one fail
+	Trusted ClientFilter
+	// Timeout of reading the header. Defaults to 10s
+	Timeout time.Duration
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &proxyProtocolConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		trusted: l.Trusted,
+		timeout: timeout,
+	}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	trusted ClientFilter
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	return c.remote
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.remote = c.Conn.RemoteAddr()
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		c.err = err
+		return
+	}
+	// neither SOCKS nor TLS clients start with these
+	if first[0] != 'P' && first[0] != proxyV2Signature[0] {
+		return
+	}
+
+	peer, _ := clientAddr(c.remote)
+	if peer == nil || c.trusted == nil || !c.trusted.Allowed(peer.IP) {
+		c.err = fmt.Errorf("PROXY protocol header from untrusted peer %s", c.remote)
+		return
+	}
+
+	var source net.Addr
+	if first[0] == 'P' {
+		source, err = readProxyHeaderV1(c.reader)
+	} else {
+		source, err = readProxyHeaderV2(c.reader)
+	}
+	if err != nil {
+		c.err = fmt.Errorf("invalid PROXY protocol header from %s: %v", c.remote, err)
+		return
+	}
+	if source != nil {
+		c.remote = source
+	}
+}
+
+// readProxyHeaderV1 reads a v1 header, eg. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 1080\r\n",
+// returning its source address, or nil for UNKNOWN connections
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// 107 bytes at most
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("not a v1 header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("expected 6 fields, got %d", len(fields))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary v2 header, returning its source address,
+// or nil for LOCAL connections and unsupported address families
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, fmt.Errorf("not a v2 header")
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	command, family := header[12]&0xF, header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0: // LOCAL, eg. health checks of the balancer
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", command)
+	}
+
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("short IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("short IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// AF_UNSPEC and AF_UNIX
+	return nil, nil
+}
+
+// writeProxyHeader sends a PROXY protocol header of the given version to a
+// target, carrying the client address of a request, and its resolved
+// destination. Version 2 headers also carry the requested domain and the
+// authenticated username
+func writeProxyHeader(w io.Writer, version uint8, req *Request) error {
+	var src, dest *net.TCPAddr
+	if req.RemoteAddr != nil {
+		src = &net.TCPAddr{IP: req.RemoteAddr.IP, Port: req.RemoteAddr.Port}
+	}
+	if req.DestAddr != nil && req.DestAddr.IP != nil {
+		// rather than the address of the target connection, which is the
+		// parent proxy's when chained
+		dest = &net.TCPAddr{IP: req.DestAddr.IP, Port: req.DestAddr.Port}
+	}
+	if src == nil || dest == nil {
+		src, dest = nil, nil
+	}
+	// both addresses are of the same family, IPv4 ones being mapped to
+	// IPv6 when the other is
+	ipv6 := src != nil && (src.IP.To4() == nil || dest.IP.To4() == nil)
+
+	var header []byte
+	switch version {
+	case 1:
+		header = proxyHeaderV1(src, dest, ipv6)
+	case 2:
+		var tlvs []byte
+		if req.DestAddr != nil && req.DestAddr.FQDN != "" {
+			tlvs = appendProxyTLV(tlvs, ProxyTLVAuthority, req.DestAddr.FQDN)
+		}
+		if req.AuthContext != nil && req.AuthContext.Payload["Username"] != "" {
+			tlvs = appendProxyTLV(tlvs, ProxyTLVUsername, req.AuthContext.Payload["Username"])
+		}
+		header = proxyHeaderV2(src, dest, ipv6, tlvs)
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+	_, err := w.Write(header)
+	return err
+}
+
+func proxyHeaderV1(src, dest *net.TCPAddr, ipv6 bool) []byte {
+	if src == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if !ipv6 {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP, dest.IP, src.Port, dest.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", proxyIPv6(src.IP), proxyIPv6(dest.IP), src.Port, dest.Port))
+}
+
+// proxyIPv6 formats an IP as IPv6, which net.IP doesn't for IPv4-mapped ones
+func proxyIPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func proxyHeaderV2(src, dest *net.TCPAddr, ipv6 bool, tlvs []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	var addrs []byte
+	switch {
+	case src == nil:
+		// LOCAL is for connections of the proxy itself, rather send an
+		// unknown family so that the TLVs are kept
+		header = append(header, 0x21, 0x00)
+	case !ipv6:
+		header = append(header, 0x21, 0x11)
+		addrs = append(addrs, src.IP.To4()...)
+		addrs = append(addrs, dest.IP.To4()...)
+	default:
+		header = append(header, 0x21, 0x21)
+		addrs = append(addrs, src.IP.To16()...)
+		addrs = append(addrs, dest.IP.To16()...)
+	}
+	if src != nil {
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dest.Port))
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)+len(tlvs)))
+	header = append(header, addrs...)
+	return append(header, tlvs...)
+}
+
+func appendProxyTLV(b []byte, typ byte, value string) []byte {
+	if len(value) > 0xFFFF {
+		value = value[:0xFFFF]
+	}
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
@@ -0,0 +1,244 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func proxyV2Header(command, family byte, addrs []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	read := func(header string) (net.Addr, error) {
+		return readProxyHeaderV1(bufio.NewReader(strings.NewReader(header)))
+	}
+
+	addr, err := read("PROXY TCP4 192.0.2.1 192.0.2.2 56324 1080\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:56324", addr.String())
+
+	addr, err = read("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1080\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:56324", addr.String())
+
+	addr, err = read("PROXY UNKNOWN\r\n")
+	assert.NoError(t, err)
+	assert.Nil(t, addr)
+
+	_, err = read("PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n")
+	assert.Error(t, err)
+	_, err = read("PROXY TCP4 nope 192.0.2.2 56324 1080\r\n")
+	assert.Error(t, err)
+	_, err = read("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n")
+	assert.ErrorContains(t, err, "too long")
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	read := func(header []byte) (net.Addr, error) {
+		return readProxyHeaderV2(bufio.NewReader(strings.NewReader(string(header))))
+	}
+
+	addr, err := read(proxyV2Header(1, 0x11, []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xDC, 0x04, 0x04, 0x38}))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:56324", addr.String())
+
+	v6 := append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...)
+	addr, err = read(proxyV2Header(1, 0x21, append(v6, 0xDC, 0x04, 0x04, 0x38)))
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:56324", addr.String())
+
+	// TLVs after the addresses are skipped
+	addr, err = read(proxyV2Header(1, 0x11, []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xDC, 0x04, 0x04, 0x38, 0x04, 0, 1, 'x'}))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:56324", addr.String())
+
+	addr, err = read(proxyV2Header(0, 0, nil))
+	assert.NoError(t, err)
+	assert.Nil(t, addr, "LOCAL connections keep their address")
+
+	_, err = read(proxyV2Header(1, 0x11, []byte{192, 0, 2, 1}))
+	assert.Error(t, err)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	target := echoServer(t)
+	metrics := NewMemoryMetrics(MemoryMetricsConfig{})
+	defer metrics.Close()
+	server, err := New(&Config{Metrics: metrics})
+	assert.NoError(t, err)
+
+	serve := func(trusted string) string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+		cidrs, _ := NewCidrSet(trusted)
+		go server.Serve(&ProxyProtocolListener{Listener: l, Trusted: cidrs, Timeout: time.Second})
+		return l.Addr().String()
+	}
+	connect := func(addr, header string) ([]byte, error) {
+		conn, err := net.Dial("tcp", addr)
+		assert.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		req := []byte(header)
+		req = append(req, socks5Version, 1, NoAuth, socks5Version, ConnectCommand, 0, ipv4Address)
+		req = append(req, target.IP.To4()...)
+		req = append(req, byte(target.Port>>8), byte(target.Port))
+		conn.Write(req)
+
+		resp := make([]byte, 12)
+		_, err = io.ReadFull(conn, resp)
+		return resp, err
+	}
+
+	trusted := serve("127.0.0.0/8")
+	resp, err := connect(trusted, "PROXY TCP4 192.0.2.1 127.0.0.1 56324 1080\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, successReply, resp[3])
+	_, err = connect(trusted, string(proxyV2Header(1, 0x11, []byte{198, 51, 100, 7, 127, 0, 0, 1, 0xDC, 0x04, 0x04, 0x38})))
+	assert.NoError(t, err)
+	_, err = connect(trusted, "")
+	assert.NoError(t, err, "trusted peers may omit the header")
+
+	hosts := map[string]bool{}
+	metrics.RangeHosts(func(host string, m *HostMetrics) {
+		hosts[host] = true
+	})
+	assert.Equal(t, map[string]bool{"192.0.2.1": true, "198.51.100.7": true, "127.0.0.1": true}, hosts)
+
+	untrusted := serve("10.0.0.0/8")
+	_, err = connect(untrusted, "PROXY TCP4 192.0.2.1 127.0.0.1 56324 1080\r\n")
+	assert.Error(t, err, "headers from untrusted peers are refused")
+	_, err = connect(untrusted, "")
+	assert.NoError(t, err)
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	req := &Request{
+		RemoteAddr:  &AddrSpec{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+		DestAddr:    &AddrSpec{FQDN: "example.com", IP: net.ParseIP("198.51.100.2"), Port: 443},
+		AuthContext: &AuthContext{UserPassAuth, map[string]string{"Username": "alice"}},
+	}
+
+	var buf strings.Builder
+	assert.NoError(t, writeProxyHeader(&buf, 1, req))
+	assert.Equal(t, "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(t, writeProxyHeader(&buf, 2, req))
+	header := []byte(buf.String())
+	addr, err := readProxyHeaderV2(bufio.NewReader(strings.NewReader(buf.String())))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:56324", addr.String())
+	tlvs := header[16+12:]
+	assert.Equal(t, append([]byte{ProxyTLVAuthority, 0, 11}, "example.com"...), tlvs[:14])
+	assert.Equal(t, append([]byte{ProxyTLVUsername, 0, 5}, "alice"...), tlvs[14:])
+
+	// mixed families are carried as IPv6
+	req.DestAddr.IP = net.ParseIP("2001:db8::2")
+	buf.Reset()
+	assert.NoError(t, writeProxyHeader(&buf, 1, req))
+	assert.Equal(t, "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n", buf.String())
+	addr, err = readProxyHeaderV1(bufio.NewReader(strings.NewReader(buf.String())))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:56324", addr.String())
+
+	buf.Reset()
+	assert.NoError(t, writeProxyHeader(&buf, 2, req))
+	assert.Equal(t, byte(0x21), buf.String()[13], "AF_INET6")
+	addr, err = readProxyHeaderV2(bufio.NewReader(strings.NewReader(buf.String())))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1:56324", addr.String())
+
+	req.DestAddr.IP = nil
+	buf.Reset()
+	assert.NoError(t, writeProxyHeader(&buf, 1, req))
+	assert.Equal(t, "PROXY UNKNOWN\r\n", buf.String())
+	req.DestAddr.IP = net.ParseIP("2001:db8::2")
+
+	req.RemoteAddr.IP = net.ParseIP("2001:db8::1")
+	buf.Reset()
+	assert.NoError(t, writeProxyHeader(&buf, 1, req))
+	assert.Equal(t, "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", buf.String())
+
+	assert.Error(t, writeProxyHeader(&buf, 3, req))
+}
+
+// proxyHeaderRule allows requests, sending a PROXY header
+type proxyHeaderRule struct{}
+
+func (proxyHeaderRule) Allow(ctx context.Context, req *Request) bool {
+	return true
+}
+
+func (proxyHeaderRule) Evaluate(ctx context.Context, req *Request) Decision {
+	return Decision{Verdict: VerdictAllow, ProxyHeader: 1}
+}
+
+func TestConnectProxyHeader(t *testing.T) {
+	target := echoServer(t)
+	server, err := New(&Config{Rules: proxyHeaderRule{}})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := []byte{socks5Version, 1, NoAuth, socks5Version, ConnectCommand, 0, ipv4Address}
+	req = append(req, target.IP.To4()...)
+	req = append(req, byte(target.Port>>8), byte(target.Port))
+	conn.Write(append(req, "ping"...))
+
+	resp := make([]byte, 12)
+	_, err = io.ReadFull(conn, resp)
+	assert.NoError(t, err)
+
+	// the echo server sends the header back
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(t, err)
+	local := conn.LocalAddr().(*net.TCPAddr)
+	assert.Equal(t, fmt.Sprintf("PROXY TCP4 127.0.0.1 %s %d %d\r\n", target.IP, local.Port, target.Port), line)
+}
+
+func TestConnectProxyHeaderChained(t *testing.T) {
+	target := echoServer(t)
+	_, parentAddr := serve(t, &Config{})
+	_, addr := serve(t, &Config{
+		Rules: proxyHeaderRule{},
+		Dial:  (&Dialer{ProxyAddress: parentAddr}).DialContext,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := (&Dialer{ProxyAddress: addr}).DialContext(ctx, "tcp", target.String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+
+	// the destination is the target, not the parent proxy
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Contains(t, line, fmt.Sprintf(" %s %d %d\r\n", target.IP, conn.LocalAddr().(*net.TCPAddr).Port, target.Port))
+}
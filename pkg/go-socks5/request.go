@@ -1,27 +1,33 @@
 package socks5
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"socks5-server-ng/pkg/bufpool"
 	"strconv"
 	"strings"
 	"time"
-
-	"github.com/puzpuzpuz/xsync/v3"
 )
 
 const (
 	ConnectCommand   = uint8(1)
 	BindCommand      = uint8(2)
 	AssociateCommand = uint8(3)
-	ipv4Address      = uint8(1)
-	fqdnAddress      = uint8(3)
-	ipv6Address      = uint8(4)
+	// UDPTunnelCommand is a non-standard command, relaying the datagrams of
+	// an association over the TCP connection, each prefixed by its length.
+	// It is handled as an AssociateCommand, see Request.Tunneled
+	UDPTunnelCommand = uint8(5)
+	// ResolveCommand is the Tor extension looking up the address of the
+	// host name in DestAddr, replied as the bound address
+	ResolveCommand = uint8(0xF0)
+	// ResolvePTRCommand is the Tor extension looking up the host name of
+	// the IP in DestAddr, replied as the bound address
+	ResolvePTRCommand = uint8(0xF1)
+	ipv4Address       = uint8(1)
+	fqdnAddress       = uint8(3)
+	ipv6Address       = uint8(4)
 )
 
 const (
@@ -88,14 +94,37 @@ type Request struct {
 	RemoteAddr *AddrSpec
 	// AddrSpec of the desired destination
 	DestAddr *AddrSpec
+	// Sniffed is true when the FQDN of DestAddr was sniffed from the
+	// client's TLS SNI or HTTP Host, rather than sent in the request.
+	// Rules allowing the request by that domain should be Pending
+	Sniffed bool
+	// Sniffing is true while the rules are checked before connecting to an
+	// IP whose domain is sniffed afterwards, when they are checked again.
+	// Rules requiring a domain shouldn't deny the request yet, and those
+	// allowing it should be Pending, not to prevail over later denials of
+	// its address
+	Sniffing bool
+	// Datagram is true when the request is the target of UDP datagrams
+	// within an association, checked against the rules before the first
+	// datagram is relayed to it
+	Datagram bool
+	// Tunneled is true when the datagrams of an association are relayed
+	// over the TCP connection, having been requested with UDPTunnelCommand
+	Tunneled bool
 	// AddrSpec of the actual destination (might be affected by rewrite)
 	realDestAddr *AddrSpec
 	bufConn      io.Reader
+
+	// built-in metrics of the request, see metricsHook
+	hostMetrics   *HostMetrics
+	targetMetrics *NetMetrics
+	udpActive     bool
 }
 
 type conn interface {
 	Write([]byte) (int, error)
 	RemoteAddr() net.Addr
+	Close() error
 }
 
 // NewRequest creates a new Request from the tcp connection
@@ -123,17 +152,22 @@ func NewRequest(bufConn io.Reader) (*Request, error) {
 		DestAddr: dest,
 		bufConn:  bufConn,
 	}
+	if request.Command == UDPTunnelCommand {
+		request.Command = AssociateCommand
+		request.Tunneled = true
+	}
 
 	return request, nil
 }
 
 // handleRequest is used for request processing after authentication
-func (s *Server) handleRequest(req *Request, conn conn) error {
+func (s *Server) handleRequest(req *Request, conn conn) (err error) {
 	ctx := context.Background()
 
-	// Resolve the address if we have a FQDN
+	// Resolve the address if we have a FQDN, the rules being checked
+	// before resolving for the resolve commands
 	dest := req.DestAddr
-	if dest.FQDN != "" {
+	if dest.FQDN != "" && req.Command != ResolveCommand && req.Command != ResolvePTRCommand {
 		addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
 		if err != nil {
 			if err := sendReply(conn, hostUnreachable, nil); err != nil {
@@ -150,10 +184,10 @@ func (s *Server) handleRequest(req *Request, conn conn) error {
 		req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
 	}
 
-	// Record metrics
-	metrics := s.hostMetrics.Get(req.RemoteAddr.IP.String()).Value()
-	metrics.Commands[req.Command].Add(1)
-	metrics.LastSeen.Store(time.Now())
+	s.hooks.OnRequest(ctx, req)
+	defer func() {
+		s.hooks.OnClose(ctx, req, err)
+	}()
 
 	// Switch on the command
 	switch req.Command {
@@ -162,7 +196,14 @@ func (s *Server) handleRequest(req *Request, conn conn) error {
 	case BindCommand:
 		return s.handleBind(ctx, conn, req)
 	case AssociateCommand:
+		if req.Tunneled {
+			return s.handleUDPTunnel(ctx, conn, req)
+		}
 		return s.handleAssociate(ctx, conn, req)
+	case ResolveCommand:
+		return s.handleResolve(ctx, conn, req)
+	case ResolvePTRCommand:
+		return s.handleResolvePTR(ctx, conn, req)
 	default:
 		// s.Metrics.NotSupported.Add(1)
 		if err := sendReply(conn, commandNotSupported, nil); err != nil {
@@ -176,24 +217,22 @@ func (s *Server) handleRequest(req *Request, conn conn) error {
 func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
 	s.config.Logger.Infof("%s connect to %s", req.RemoteAddr.String(), req.realDestAddr.String())
 
-	host := s.hostMetrics.Get(req.RemoteAddr.IP.String()).Value()
-	host.Active.Add(1)
-	defer host.Active.Add(-1)
-
-	targetMetric := s.targetMetrics.Get(req.DestAddr.FqdnOrIP()).Value()
-	targetMetric.Active.Add(1)
-	defer targetMetric.Active.Add(-1)
+	// Connecting to an IP, rules are checked again once the domain was sniffed
+	sniff := s.config.SniffDomains && req.DestAddr.FQDN == ""
 
 	// Check if this is allowed
-	if ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+	req.Sniffing = sniff
+	d := s.evaluate(ctx, req)
+	req.Sniffing = false
+	if d.Verdict == VerdictDeny {
+		if err := sendReply(conn, d.reply(), nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
-		return fmt.Errorf("Connect to %v blocked by rules", req.DestAddr)
+		return fmt.Errorf("Connect to %v blocked, %v", req.DestAddr, d)
 	}
 
 	// Attempt to connect
-	target, err := s.dial(ctx, "tcp", req.realDestAddr.Address())
+	target, err := s.dial(ctx, req, "tcp", req.realDestAddr.Address())
 	if err != nil {
 		msg := err.Error()
 		resp := hostUnreachable
@@ -210,21 +249,34 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) err
 	defer target.Close()
 
 	// Send success
-	local := target.LocalAddr().(*net.TCPAddr)
-	bind := AddrSpec{IP: local.IP, Port: local.Port}
-	if err := sendReply(conn, successReply, &bind); err != nil {
+	// the target may be relayed by a parent proxy, see Dialer
+	bind, _ := addrSpecOf(target.LocalAddr())
+	if err := sendReply(conn, successReply, bind); err != nil {
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
 
+	if sniff {
+		if name := s.sniffDomain(conn, req); name != "" {
+			req.DestAddr.FQDN = name
+			req.Sniffed = true
+			s.config.Logger.Infof("%s connect to %s (sniffed)", req.RemoteAddr.String(), req.DestAddr.String())
+		}
+		// rules allowing the sniffed domain are Pending, the client
+		// being able to forge it: none may deny the address either
+		if d = s.evaluate(ctx, req); d.Verdict == VerdictDeny {
+			return fmt.Errorf("Connect to %v blocked, %v", req.DestAddr, d)
+		}
+	}
+	defer s.closeAt(d.Until, req, conn, target)()
+
+	if d.ProxyHeader != 0 {
+		if err := writeProxyHeader(target, d.ProxyHeader, req); err != nil {
+			return fmt.Errorf("Failed to send PROXY header to %v: %v", req.DestAddr, err)
+		}
+	}
+
 	// Proxy
-	proxyTx := proxy(target, req.bufConn, func(i int) {
-		host.Tx.Add(int64(i))
-		targetMetric.Tx.Add(int64(i))
-	})
-	proxyRx := proxy(conn, target, func(i int) {
-		host.Rx.Add(int64(i))
-		targetMetric.Rx.Add(int64(i))
-	})
+	proxyTx, proxyRx := s.relay(ctx, req, conn, target)
 
 	if err := <-proxyRx; err != nil {
 		return err
@@ -241,11 +293,11 @@ func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error
 	s.config.Logger.Warnf("Bind requested by %s, but unsupported", req.RemoteAddr)
 
 	// Check if this is allowed
-	if ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+	if d := s.evaluate(ctx, req); d.Verdict == VerdictDeny {
+		if err := sendReply(conn, d.reply(), nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
-		return fmt.Errorf("Bind to %v blocked by rules", req.DestAddr)
+		return fmt.Errorf("Bind to %v blocked, %v", req.DestAddr, d)
 	}
 
 	// TODO: Support bind
@@ -258,17 +310,14 @@ func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error
 // handleAssociate is used to handle a connect command
 func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
-	if ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+	d := s.evaluate(ctx, req)
+	if d.Verdict == VerdictDeny {
+		if err := sendReply(conn, d.reply(), nil); err != nil {
 			return fmt.Errorf("Failed to send reply: %v", err)
 		}
-		return fmt.Errorf("Associate to %v blocked by rules", req.DestAddr)
+		return fmt.Errorf("Associate to %v blocked, %v", req.DestAddr, d)
 	}
 
-	metric := s.hostMetrics.Get(req.RemoteAddr.IP.String()).Value()
-	metric.ActiveUDP.Add(1)
-	defer metric.ActiveUDP.Add(-1)
-
 	// Create UDP to listen on
 	listenUdpSock, err := net.ListenUDP("udp", nil)
 	if err != nil {
@@ -277,6 +326,7 @@ func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) e
 		return err
 	}
 	defer listenUdpSock.Close()
+	defer s.closeAt(d.Until, req, conn, listenUdpSock)()
 
 	// Tell client we've opened a UDP socket
 	bindAddr := listenUdpSock.LocalAddr().(*net.UDPAddr)
@@ -285,8 +335,11 @@ func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) e
 		return err
 	}
 
-	// Start receiving on UDP
-	go s.handleAssociateConnection(ctx, metric, req.RemoteAddr, listenUdpSock)
+	// Start receiving on UDP, the association ends when it is idle
+	go func() {
+		s.handleAssociateConnection(ctx, req, listenUdpSock)
+		conn.Close()
+	}()
 
 	// Wait to read EOF/Closed
 	miscBuf := [8]byte{}
@@ -302,98 +355,116 @@ func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) e
 	return nil
 }
 
-func (s *Server) handleAssociateConnection(ctx context.Context, metric *HostMetrics, reqDestAddr *AddrSpec, sock *net.UDPConn) {
-	buf := bufpool.Pool4096.Get()
-	defer bufpool.Pool4096.Return(buf)
-
-	targetConns := xsync.NewMapOf[string, net.Conn]()
-	defer func() {
-		targetConns.Range(func(key string, value net.Conn) bool {
-			value.Close()
-			return true
-		})
-		targetConns.Clear()
-	}()
+// handleResolve is used to handle a resolve command, replying with the
+// address of the host name
+func (s *Server) handleResolve(ctx context.Context, conn conn, req *Request) error {
+	// Check if this is allowed
+	if d := s.evaluate(ctx, req); d.Verdict == VerdictDeny {
+		if err := sendReply(conn, d.reply(), nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Resolve of %v blocked, %v", req.DestAddr, d)
+	}
 
-	for {
-		n, srcAddr, err := sock.ReadFromUDP(buf)
-		if err != nil {
-			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-				break
+	// An IP resolves to itself
+	dest := req.realDestAddr
+	ip := dest.IP
+	if dest.FQDN != "" {
+		var err error
+		if ip, err = s.config.Resolver.Resolve(ctx, dest.FQDN); err != nil {
+			if err := sendReply(conn, hostUnreachable, nil); err != nil {
+				return fmt.Errorf("Failed to send reply: %v", err)
 			}
-			continue
+			return fmt.Errorf("Failed to resolve '%v': %v", dest.FQDN, err)
 		}
+	}
 
-		reader := bytes.NewReader(buf[:n])
-
-		// Skip RSV & frag
-		reader.Seek(3, io.SeekCurrent)
+	s.config.Logger.Infof("%s resolved %s to %s", req.RemoteAddr, dest.FqdnOrIP(), ip)
+	return sendReply(conn, successReply, &AddrSpec{IP: ip})
+}
 
-		// parse datagram
-		targetAddr, _ := readAddrSpec(reader)
-		headerEndPos, _ := reader.Seek(0, io.SeekCurrent)
-		header := buf[:headerEndPos]
-		data := buf[headerEndPos : n-int(headerEndPos)]
+// handleResolvePTR is used to handle a resolve PTR command, replying with
+// the host name of the IP
+func (s *Server) handleResolvePTR(ctx context.Context, conn conn, req *Request) error {
+	reverse, ok := s.config.Resolver.(ReverseResolver)
+	if !ok {
+		if err := sendReply(conn, commandNotSupported, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Resolver %T can't resolve PTR", s.config.Resolver)
+	}
+	if req.DestAddr.FQDN != "" {
+		if err := sendReply(conn, addrTypeNotSupported, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("Resolve PTR of a host name: %v", req.DestAddr)
+	}
 
-		// Check if src equal
-		if !srcAddr.IP.Equal(reqDestAddr.IP) {
-			s.config.Logger.Warnf("UDP Source packet (%s) is not expected (%s)", srcAddr, reqDestAddr)
-			continue
+	// Check if this is allowed
+	if d := s.evaluate(ctx, req); d.Verdict == VerdictDeny {
+		if err := sendReply(conn, d.reply(), nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
 		}
+		return fmt.Errorf("Resolve PTR of %v blocked, %v", req.DestAddr, d)
+	}
 
-		// Start proxying to target (UDP-style)
-		targetKey := srcAddr.String() + "--" + targetAddr.String()
-		targetSock, hasTargetSock := targetConns.Load(targetKey)
-		if !hasTargetSock {
-			targetSock, err = s.dial(ctx, "udp", targetAddr.Address())
-			if err != nil {
-				continue
-			}
-			targetConns.Store(targetKey, targetSock)
-			s.config.Logger.Debugf("New UDP target %s for %s", targetAddr.Address(), srcAddr.String())
-
-			// Start proxy target back to client
-			go func() {
-				defer func() {
-					targetSock.Close()
-					targetConns.Delete(targetKey)
-					s.config.Logger.Debugf("Closed %s", targetKey)
-				}()
-
-				buf := make([]byte, 4096+len(header))
-				copy(buf, header)
-				for {
-					n, err := targetSock.Read(buf[len(header):])
-					if err != nil {
-						break
-					}
-
-					// Send to src
-					metric.Rx.Add(int64(n))
-					if _, err := sock.WriteToUDP(buf[:len(header)+n], srcAddr); err != nil {
-						break
-					}
-				}
-			}()
+	name, err := reverse.ResolveAddr(ctx, req.DestAddr.IP)
+	if err != nil {
+		if err := sendReply(conn, hostUnreachable, nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
 		}
+		return fmt.Errorf("Failed to resolve PTR of '%v': %v", req.DestAddr.IP, err)
+	}
 
-		// Pass data to target
-		metric.Tx.Add(int64(len(data)))
-		if _, err := targetSock.Write(data); err != nil {
-			if !errors.Is(err, io.EOF) || !errors.Is(err, net.ErrClosed) {
-				s.config.Logger.Warnf("Error sending for %s: %v", targetSock.RemoteAddr().String(), err)
-			}
-			targetSock.Close()
-			continue
+	s.config.Logger.Infof("%s resolved %s to %s", req.RemoteAddr, req.DestAddr.IP, name)
+	return sendReply(conn, successReply, &AddrSpec{FQDN: name})
+}
+
+// evaluate checks the request against the Rules, and notifies the hooks.
+// A request no rule objected to is allowed
+func (s *Server) evaluate(ctx context.Context, req *Request) Decision {
+	d := evaluate(ctx, s.config.Rules, req)
+	if d.Verdict == VerdictAbstain {
+		d.Verdict = VerdictAllow
+	}
+	s.hooks.OnRuleDecision(ctx, req, d)
+	return d
+}
+
+// closeAt closes a session at the given time, if not zero.
+// The returned function cancels it
+func (s *Server) closeAt(until time.Time, req *Request, closers ...io.Closer) (cancel func()) {
+	if until.IsZero() {
+		return func() {}
+	}
+	timer := time.AfterFunc(time.Until(until), func() {
+		s.config.Logger.Infof("%s session to %s closed, allowed until %s", req.RemoteAddr, req.DestAddr, until.Format(time.RFC3339))
+		for _, c := range closers {
+			c.Close()
 		}
+	})
+	return func() {
+		timer.Stop()
 	}
 }
 
-func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+// dial connects to a target on behalf of a request, and notifies the hooks
+func (s *Server) dial(ctx context.Context, req *Request, network, addr string) (net.Conn, error) {
+	s.hooks.OnDialStart(ctx, req, network, addr)
+
+	var target net.Conn
+	var err error
 	if s.config.Dial != nil {
-		return s.config.Dial(ctx, network, addr)
+		target, err = s.config.Dial(ctx, network, addr)
+	} else {
+		target, err = net.Dial(network, addr)
+	}
+
+	s.hooks.OnDialFinish(ctx, req, target, err)
+	if err != nil {
+		return nil, err
 	}
-	return net.Dial(network, addr)
+	return s.hooks.WrapTargetConn(ctx, req, target), nil
 }
 
 type closeWriter interface {
@@ -402,11 +473,11 @@ type closeWriter interface {
 
 // proxy is used to shuffle data from src to destination, and sends errors
 // down a dedicated channel
-func proxy(dst io.Writer, src io.Reader, onRead func(int)) <-chan error {
+func (s *Server) proxy(dst io.Writer, src io.Reader, onRead func(int)) <-chan error {
 	ret := make(chan error, 1)
 	go func() {
-		buf := bufpool.Pool4096.Get()
-		defer bufpool.Pool4096.Return(buf)
+		buf := s.config.Buffers.Get(s.config.BufferSize)
+		defer s.config.Buffers.Return(buf)
 
 		for {
 			n, err := src.Read(buf)
@@ -14,6 +14,24 @@ type NameResolver interface {
 	Resolve(ctx context.Context, name string) (net.IP, error)
 }
 
+// ReverseResolver is implemented by NameResolvers which can look up the
+// host name of an address, for ResolvePTRCommand
+type ReverseResolver interface {
+	ResolveAddr(ctx context.Context, ip net.IP) (string, error)
+}
+
+// firstName returns the first name of a reverse lookup, without its
+// trailing dot
+func firstName(names []string, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", errors.New("resolve: no name")
+	}
+	return strings.TrimSuffix(names[0], "."), nil
+}
+
 // SysDNSResolver uses the system DNS to resolve host names
 type SysDNSResolver struct{}
 
@@ -25,6 +43,10 @@ func (d SysDNSResolver) Resolve(ctx context.Context, name string) (net.IP, error
 	return addr.IP, err
 }
 
+func (d SysDNSResolver) ResolveAddr(ctx context.Context, ip net.IP) (string, error) {
+	return firstName(net.DefaultResolver.LookupAddr(ctx, ip.String()))
+}
+
 // CustomResolver uses a specific name server IP to resolve domains
 type CustomResolver struct {
 	r       *net.Resolver
@@ -64,3 +86,7 @@ func (d *CustomResolver) Resolve(ctx context.Context, name string) (net.IP, erro
 		return addrs[rand.Intn(len(addrs))], nil
 	}
 }
+
+func (d *CustomResolver) ResolveAddr(ctx context.Context, ip net.IP) (string, error) {
+	return firstName(d.r.LookupAddr(ctx, ip.String()))
+}
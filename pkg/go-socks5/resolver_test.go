@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stubResolver resolves the names and addresses it knows
+type stubResolver map[string]string
+
+func (r stubResolver) Resolve(ctx context.Context, name string) (net.IP, error) {
+	if ip, ok := r[name]; ok {
+		return net.ParseIP(ip), nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (r stubResolver) ResolveAddr(ctx context.Context, ip net.IP) (string, error) {
+	for name, addr := range r {
+		if net.ParseIP(addr).Equal(ip) {
+			return name, nil
+		}
+	}
+	return "", errors.New("no such host")
+}
+
+// denyDest denies the requests to a host name
+type denyDest string
+
+func (d denyDest) Allow(ctx context.Context, req *Request) bool {
+	return req.DestAddr.FQDN != string(d)
+}
+
+// request sends a request to the server with a new connection, and returns
+// the address of its reply
+func request(t *testing.T, l net.Listener, cmd uint8, addr *AddrSpec) (*AddrSpec, error) {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	assert.NoError(t, clientHandshake(conn, "", ""))
+	return clientRequest(conn, cmd, addr)
+}
+
+func TestResolveCommands(t *testing.T) {
+	server, err := New(&Config{
+		Resolver: stubResolver{"example.com": "93.184.216.34", "blocked.example": "10.0.0.1"},
+		Rules:    denyDest("blocked.example"),
+	})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go server.Serve(l)
+
+	addr, err := request(t, l, ResolveCommand, &AddrSpec{FQDN: "example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "93.184.216.34", addr.IP.String())
+
+	_, err = request(t, l, ResolveCommand, &AddrSpec{FQDN: "blocked.example"})
+	assert.Equal(t, ReplyError(ruleFailure), err)
+	_, err = request(t, l, ResolveCommand, &AddrSpec{FQDN: "unknown.example"})
+	assert.Equal(t, ReplyError(hostUnreachable), err)
+
+	addr, err = request(t, l, ResolvePTRCommand, &AddrSpec{IP: net.ParseIP("93.184.216.34")})
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", addr.FQDN)
+	_, err = request(t, l, ResolvePTRCommand, &AddrSpec{FQDN: "example.com"})
+	assert.Equal(t, ReplyError(addrTypeNotSupported), err)
+
+	// unknown commands are counted apart
+	_, err = request(t, l, 0x42, &AddrSpec{IP: net.IPv4zero})
+	assert.Equal(t, ReplyError(commandNotSupported), err)
+
+	host := server.config.Metrics.Host("127.0.0.1")
+	assert.EqualValues(t, 3, host.Commands[commandSlot(ResolveCommand)].Load())
+	assert.EqualValues(t, 2, host.Commands[commandSlot(ResolvePTRCommand)].Load())
+	assert.EqualValues(t, 1, host.Commands[0].Load())
+}
+
+func TestResolvePTRUnsupported(t *testing.T) {
+	server, err := New(&Config{Resolver: resolverFunc(func(ctx context.Context, name string) (net.IP, error) {
+		return net.IPv4(127, 0, 0, 1), nil
+	})})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go server.Serve(l)
+
+	_, err = request(t, l, ResolvePTRCommand, &AddrSpec{IP: net.ParseIP("127.0.0.1")})
+	assert.Equal(t, ReplyError(commandNotSupported), err)
+}
+
+type resolverFunc func(ctx context.Context, name string) (net.IP, error)
+
+func (f resolverFunc) Resolve(ctx context.Context, name string) (net.IP, error) {
+	return f(ctx, name)
+}
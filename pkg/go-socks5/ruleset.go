@@ -1,12 +1,94 @@
 package socks5
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"time"
+)
 
 // RuleSet is used to provide custom rules to allow or prohibit actions
 type RuleSet interface {
 	Allow(ctx context.Context, req *Request) bool
 }
 
+// Verdict of a Rule
+type Verdict uint8
+
+const (
+	// VerdictAbstain leaves the decision to the next rule
+	VerdictAbstain Verdict = iota
+	VerdictAllow
+	VerdictDeny
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictAllow:
+		return "allow"
+	case VerdictDeny:
+		return "deny"
+	default:
+		return "abstain"
+	}
+}
+
+// Reply codes which can be sent to the client with a Decision
+const (
+	ReplyNotAllowed         = ruleFailure
+	ReplyNetworkUnreachable = networkUnreachable
+	ReplyHostUnreachable    = hostUnreachable
+	ReplyConnectionRefused  = connectionRefused
+)
+
+// Decision is the result of evaluating a request against a Rule
+type Decision struct {
+	Verdict Verdict
+	// Rule is the name of the rule which decided
+	Rule string
+	// Reason is a human readable explanation of the decision
+	Reason string
+	// Reply is the code sent to the client when denied.
+	// Defaults to ReplyNotAllowed
+	Reply uint8
+	// Until, if set on an allowed decision, is when the session is closed
+	Until time.Time
+	// ProxyHeader, if set on an allowed CONNECT decision, is the version
+	// (1 or 2) of a PROXY protocol header sent to the target before the
+	// client data, carrying the client address
+	ProxyHeader uint8
+	// Pending is set on an allowed decision which depends on a domain the
+	// client may forge, as it is sniffed, see Request.Sniffing. FirstMatch
+	// then evaluates the rules after it, and a denial ByAddress prevails
+	Pending bool
+	// ByAddress is set on a denial because of the destination's address or
+	// port, whatever its domain
+	ByAddress bool
+}
+
+func (d Decision) String() string {
+	ret := d.Verdict.String()
+	if d.Rule != "" {
+		ret += " by " + d.Rule
+	}
+	if d.Reason != "" {
+		ret += ": " + d.Reason
+	}
+	return ret
+}
+
+func (d Decision) reply() uint8 {
+	if d.Reply == successReply {
+		return ReplyNotAllowed
+	}
+	return d.Reply
+}
+
+// Rule is a RuleSet which explains its decisions.
+// Rules can be assigned to Config.Rules, and are preferred over Allow.
+type Rule interface {
+	Evaluate(ctx context.Context, req *Request) Decision
+}
+
 // Permit value globally
 type PermitDefault struct {
 	Value bool
@@ -26,6 +108,14 @@ func (p *PermitDefault) Allow(ctx context.Context, req *Request) bool {
 	return p.Value
 }
 
+func (p *PermitDefault) Evaluate(ctx context.Context, req *Request) Decision {
+	if p.Value {
+		return Decision{Verdict: VerdictAllow, Rule: "default"}
+	}
+	return Decision{Verdict: VerdictDeny, Rule: "default"}
+}
+
+// PermitChain requires all its RuleSets to allow a request
 type PermitChain []RuleSet
 
 func (s PermitChain) Allow(ctx context.Context, req *Request) bool {
@@ -36,3 +126,84 @@ func (s PermitChain) Allow(ctx context.Context, req *Request) bool {
 	}
 	return true
 }
+
+// Evaluate returns the decision of the first RuleSet denying the request
+func (s PermitChain) Evaluate(ctx context.Context, req *Request) Decision {
+	for _, rule := range s {
+		if d := evaluate(ctx, rule, req); d.Verdict == VerdictDeny {
+			return d
+		}
+	}
+	return Decision{Verdict: VerdictAllow}
+}
+
+// FirstMatch evaluates its rules in order, and the first one which doesn't
+// abstain decides. If all abstain, the Default verdict applies.
+//
+// A Pending allowance only decides if none of the rules after it deny the
+// request ByAddress, or allow it.
+type FirstMatch struct {
+	Rules   []Rule
+	Default Verdict
+}
+
+func (s *FirstMatch) Allow(ctx context.Context, req *Request) bool {
+	return s.Evaluate(ctx, req).Verdict == VerdictAllow
+}
+
+func (s *FirstMatch) Evaluate(ctx context.Context, req *Request) Decision {
+	var pending *Decision
+	for _, rule := range s.Rules {
+		d := rule.Evaluate(ctx, req)
+		switch {
+		case d.Verdict == VerdictAbstain:
+		case d.Pending:
+			if pending == nil {
+				pending = &d
+			}
+		case pending == nil || d.Verdict == VerdictAllow || d.ByAddress:
+			return d
+		}
+	}
+	if pending != nil {
+		return *pending
+	}
+	return Decision{Verdict: s.Default, Rule: "default"}
+}
+
+// Named adapts a RuleSet into a named Rule. A RuleSet which doesn't
+// implement Rule denies when it disallows a request, and abstains otherwise.
+func Named(name string, rs RuleSet) Rule {
+	return &namedRule{name, rs}
+}
+
+type namedRule struct {
+	name string
+	rs   RuleSet
+}
+
+func (s *namedRule) Evaluate(ctx context.Context, req *Request) Decision {
+	if r, ok := s.rs.(Rule); ok {
+		d := r.Evaluate(ctx, req)
+		if d.Rule == "" && d.Verdict != VerdictAbstain {
+			d.Rule = s.name
+		}
+		return d
+	}
+	if !s.rs.Allow(ctx, req) {
+		return Decision{Verdict: VerdictDeny, Rule: s.name}
+	}
+	return Decision{Verdict: VerdictAbstain}
+}
+
+// evaluate a RuleSet, using its Rule implementation if any.
+// A RuleSet which isn't a Rule allows or denies, it never abstains
+func evaluate(ctx context.Context, rs RuleSet, req *Request) Decision {
+	if r, ok := rs.(Rule); ok {
+		return r.Evaluate(ctx, req)
+	}
+	if rs.Allow(ctx, req) {
+		return Decision{Verdict: VerdictAllow}
+	}
+	return Decision{Verdict: VerdictDeny, Rule: fmt.Sprintf("%T", rs)}
+}
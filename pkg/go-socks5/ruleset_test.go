@@ -0,0 +1,108 @@
+package socks5
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// decide is a Rule with a fixed Decision
+type decide Decision
+
+func (d decide) Allow(ctx context.Context, req *Request) bool {
+	return d.Verdict != VerdictDeny
+}
+
+func (d decide) Evaluate(ctx context.Context, req *Request) Decision {
+	return Decision(d)
+}
+
+var (
+	abstain   = decide{}
+	allowRule = decide{Verdict: VerdictAllow, Rule: "allow-rule"}
+	denyRule  = decide{Verdict: VerdictDeny, Rule: "deny-rule", Reply: ReplyHostUnreachable}
+	// a rule allowing a domain to sniff, and one denying an address
+	pendingRule = decide{Verdict: VerdictAllow, Rule: "pending-rule", Pending: true}
+	addressRule = decide{Verdict: VerdictDeny, Rule: "address-rule", ByAddress: true}
+)
+
+func TestFirstMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []Rule
+		def     Verdict
+		verdict Verdict
+		rule    string
+	}{
+		{"no rules", nil, VerdictAllow, VerdictAllow, "default"},
+		{"all abstain", []Rule{abstain, abstain}, VerdictDeny, VerdictDeny, "default"},
+		{"abstain falls through", []Rule{abstain, denyRule, allowRule}, VerdictAllow, VerdictDeny, "deny-rule"},
+		{"first match decides", []Rule{allowRule, denyRule}, VerdictDeny, VerdictAllow, "allow-rule"},
+		{"named denial", []Rule{abstain, Named("dest", denyDest("example.com"))}, VerdictAllow, VerdictDeny, "dest"},
+		{"named allowance abstains", []Rule{Named("dest", denyDest("other.com")), denyRule}, VerdictAllow, VerdictDeny, "deny-rule"},
+		{"pending denied by address", []Rule{pendingRule, denyRule, addressRule}, VerdictAllow, VerdictDeny, "address-rule"},
+		{"pending over denial", []Rule{pendingRule, denyRule}, VerdictDeny, VerdictAllow, "pending-rule"},
+		{"pending over default", []Rule{pendingRule, abstain}, VerdictDeny, VerdictAllow, "pending-rule"},
+		{"pending then allowed", []Rule{pendingRule, allowRule, addressRule}, VerdictDeny, VerdictAllow, "allow-rule"},
+		{"first pending decides", []Rule{pendingRule, decide{Verdict: VerdictAllow, Rule: "other", Pending: true}}, VerdictDeny, VerdictAllow, "pending-rule"},
+		{"address denial first", []Rule{addressRule, pendingRule}, VerdictAllow, VerdictDeny, "address-rule"},
+	}
+	req := &Request{Command: ConnectCommand, DestAddr: &AddrSpec{FQDN: "example.com", Port: 443}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := &FirstMatch{Rules: tt.rules, Default: tt.def}
+			d := rules.Evaluate(context.Background(), req)
+			assert.Equal(t, tt.verdict, d.Verdict)
+			assert.Equal(t, tt.rule, d.Rule)
+			assert.Equal(t, tt.verdict == VerdictAllow, rules.Allow(context.Background(), req))
+		})
+	}
+}
+
+func TestNamed(t *testing.T) {
+	tests := []struct {
+		name string
+		rs   RuleSet
+		want Decision
+	}{
+		{"unnamed decision", decide{Verdict: VerdictDeny, Reason: "why"}, Decision{Verdict: VerdictDeny, Rule: "named", Reason: "why"}},
+		{"named decision", denyRule, Decision(denyRule)},
+		{"abstention", abstain, Decision{}},
+		{"ruleset denial", PermitNone(), Decision{Verdict: VerdictDeny, Rule: "default"}},
+		{"ruleset allowance", denyDest("other.com"), Decision{}},
+		{"ruleset disallowance", denyDest("example.com"), Decision{Verdict: VerdictDeny, Rule: "named"}},
+	}
+	req := &Request{Command: ConnectCommand, DestAddr: &AddrSpec{FQDN: "example.com", Port: 443}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Named("named", tt.rs).Evaluate(context.Background(), req))
+		})
+	}
+}
+
+func TestPermitChain(t *testing.T) {
+	tests := []struct {
+		name  string
+		chain PermitChain
+		want  Decision
+	}{
+		{"empty", nil, Decision{Verdict: VerdictAllow}},
+		{"abstentions allow", PermitChain{abstain, allowRule}, Decision{Verdict: VerdictAllow}},
+		{"first denial", PermitChain{allowRule, denyRule, PermitNone()}, Decision(denyRule)},
+		{"ruleset denial", PermitChain{PermitAll(), denyDest("example.com")}, Decision{Verdict: VerdictDeny, Rule: "socks5.denyDest"}},
+	}
+	req := &Request{Command: ConnectCommand, DestAddr: &AddrSpec{FQDN: "example.com", Port: 443}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.chain.Evaluate(context.Background(), req))
+			assert.Equal(t, tt.want.Verdict == VerdictAllow, tt.chain.Allow(context.Background(), req))
+		})
+	}
+}
+
+func TestDecisionReply(t *testing.T) {
+	assert.Equal(t, ReplyNotAllowed, Decision{Verdict: VerdictDeny}.reply())
+	assert.Equal(t, ReplyHostUnreachable, Decision(denyRule).reply())
+	assert.Equal(t, "deny by deny-rule: why", Decision{Verdict: VerdictDeny, Rule: "deny-rule", Reason: "why"}.String())
+}
@@ -0,0 +1,199 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSniffTimeout = time.Second
+
+	tlsRecordHandshake    = 0x16
+	tlsClientHello        = 0x01
+	tlsExtensionSNI       = 0x0000
+	tlsSNIHostName        = 0x00
+	tlsRecordHeaderLen    = 5
+	tlsHandshakeHeaderLen = 4
+)
+
+// first 4 bytes of HTTP/1 requests
+var httpMethodPrefixes = [...]string{"GET ", "POST", "PUT ", "HEAD", "DELE", "OPTI", "PATC", "CONN", "TRAC"}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// sniffDomain waits for the first bytes sent by the client, and extracts
+// the TLS SNI or HTTP Host from them, without consuming them.
+// Returns an empty string if no name was found within the SniffTimeout.
+func (s *Server) sniffDomain(conn conn, req *Request) string {
+	br, ok := req.bufConn.(*bufio.Reader)
+	if !ok {
+		return ""
+	}
+	dl, ok := conn.(readDeadliner)
+	if !ok {
+		return ""
+	}
+
+	timeout := s.config.SniffTimeout
+	if timeout <= 0 {
+		timeout = defaultSniffTimeout
+	}
+	dl.SetReadDeadline(time.Now().Add(timeout))
+	defer dl.SetReadDeadline(time.Time{})
+
+	return sniffDomain(br)
+}
+
+func sniffDomain(br *bufio.Reader) string {
+	head, err := br.Peek(tlsRecordHeaderLen)
+	if err != nil {
+		return ""
+	}
+
+	// TLS
+	if head[0] == tlsRecordHandshake && head[1] == 3 {
+		n := tlsRecordHeaderLen + int(binary.BigEndian.Uint16(head[3:5]))
+		if n > br.Size() {
+			n = br.Size()
+		}
+		record, _ := br.Peek(n)
+		return parseTLSServerName(record[tlsRecordHeaderLen:])
+	}
+
+	// HTTP
+	for _, prefix := range httpMethodPrefixes {
+		if string(head[:len(prefix)]) != prefix {
+			continue
+		}
+		for {
+			data, _ := br.Peek(br.Buffered())
+			if host, done := parseHTTPHost(data); done {
+				return host
+			}
+			if len(data) >= br.Size() {
+				return ""
+			}
+			// wait for more
+			if _, err := br.Peek(len(data) + 1); err != nil {
+				return ""
+			}
+		}
+	}
+
+	return ""
+}
+
+// parseTLSServerName extracts the server_name extension from a ClientHello handshake message
+func parseTLSServerName(msg []byte) string {
+	if len(msg) < tlsHandshakeHeaderLen || msg[0] != tlsClientHello {
+		return ""
+	}
+	p := msg[tlsHandshakeHeaderLen:]
+
+	// version(2) + random(32)
+	if len(p) < 34 {
+		return ""
+	}
+	p = p[34:]
+
+	// session id, cipher suites, compression methods
+	var ok bool
+	if _, p, ok = readVector(p, 1); !ok {
+		return ""
+	}
+	if _, p, ok = readVector(p, 2); !ok {
+		return ""
+	}
+	if _, p, ok = readVector(p, 1); !ok {
+		return ""
+	}
+
+	exts, _, ok := readVector(p, 2)
+	if !ok {
+		return ""
+	}
+	for len(exts) >= 4 {
+		extType := binary.BigEndian.Uint16(exts)
+		var ext []byte
+		if ext, exts, ok = readVector(exts[2:], 2); !ok {
+			return ""
+		}
+		if extType != tlsExtensionSNI {
+			continue
+		}
+
+		names, _, ok := readVector(ext, 2)
+		if !ok {
+			return ""
+		}
+		for len(names) > 0 {
+			nameType := names[0]
+			var name []byte
+			if name, names, ok = readVector(names[1:], 2); !ok {
+				return ""
+			}
+			if nameType == tlsSNIHostName {
+				return string(name)
+			}
+		}
+	}
+
+	return ""
+}
+
+// readVector reads a TLS vector prefixed with a big-endian length of lenSize bytes
+func readVector(p []byte, lenSize int) (vec, rest []byte, ok bool) {
+	if len(p) < lenSize {
+		return nil, nil, false
+	}
+	n := 0
+	for i := 0; i < lenSize; i++ {
+		n = n<<8 | int(p[i])
+	}
+	p = p[lenSize:]
+	if len(p) < n {
+		return nil, nil, false
+	}
+	return p[:n], p[n:], true
+}
+
+// parseHTTPHost extracts the Host header of an HTTP/1 request.
+// done is false while the headers are incomplete
+func parseHTTPHost(data []byte) (host string, done bool) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	complete := end >= 0
+	if complete {
+		data = data[:end]
+	}
+
+	// skip the request line, and the last line which may be partial
+	lines := bytes.Split(data, []byte("\r\n"))
+	if !complete {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > 0 {
+		lines = lines[1:]
+	}
+	for _, line := range lines {
+		name, value, found := bytes.Cut(line, []byte(":"))
+		if !found || !strings.EqualFold(string(name), "host") {
+			continue
+		}
+		host = strings.TrimSpace(string(value))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) != nil {
+			return "", true
+		}
+		return host, true
+	}
+
+	return "", complete
+}
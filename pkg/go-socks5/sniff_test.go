@@ -0,0 +1,98 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSniffTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: "sni.example.com"}).Handshake()
+	}()
+	defer client.Close()
+
+	assert.Equal(t, "sni.example.com", sniffDomain(bufio.NewReader(server)))
+}
+
+func TestSniffHTTP(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nUser-Agent: test\r\nhost: www.example.com:8080\r\n\r\n"))
+	assert.Equal(t, "www.example.com", sniffDomain(br))
+
+	// Nothing was consumed
+	line, _ := br.ReadString('\n')
+	assert.Equal(t, "GET / HTTP/1.1\r\n", line)
+
+	assert.Equal(t, "", sniffDomain(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: 10.0.0.1\r\n\r\n"))))
+	assert.Equal(t, "", sniffDomain(bufio.NewReader(strings.NewReader("SSH-2.0-OpenSSH\r\n"))))
+}
+
+// sniffRules denies a port by address, and any domain but one
+type sniffRules struct {
+	deniedPort int
+	domain     string
+}
+
+func (r sniffRules) Allow(ctx context.Context, req *Request) bool {
+	if req.DestAddr.Port == r.deniedPort {
+		return false
+	}
+	return req.Sniffing || req.DestAddr.FQDN == r.domain
+}
+
+func TestSniffRules(t *testing.T) {
+	target := echoServer(t)
+	denied, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer denied.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		if conn, err := denied.Accept(); err == nil {
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+
+	_, addr := serve(t, &Config{
+		SniffDomains: true,
+		SniffTimeout: 100 * time.Millisecond,
+		Rules:        sniffRules{denied.Addr().(*net.TCPAddr).Port, "allowed.example"},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	d := &Dialer{ProxyAddress: addr}
+
+	// the rules are checked on the IP before connecting to it
+	_, err = d.DialContext(ctx, "tcp", denied.Addr().String())
+	assert.ErrorIs(t, err, ReplyError(ruleFailure))
+	select {
+	case <-accepted:
+		t.Error("denied target was connected")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// and again on the sniffed domain
+	request := func(host string) string {
+		conn, err := d.DialContext(ctx, "tcp", target.String())
+		assert.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		msg := "GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+		conn.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		n, _ := io.ReadFull(conn, buf)
+		return string(buf[:n])
+	}
+	assert.Contains(t, request("allowed.example"), "Host: allowed.example")
+	assert.Empty(t, request("other.example"))
+}
@@ -3,12 +3,15 @@ package socks5
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
-	"sync/atomic"
+	"socks5-server-ng/pkg/bufpool"
+	"strconv"
 	"time"
 
-	"github.com/jellydator/ttlcache/v3"
+	"github.com/puzpuzpuz/xsync/v3"
 	"github.com/sirupsen/logrus"
 )
 
@@ -18,6 +21,10 @@ const (
 
 // Config is used to setup and configure a Server
 type Config struct {
+	// Name identifies the Server in the listener metrics, when several
+	// share the Metrics. Defaults to "default"
+	Name string
+
 	// Client Filter RuleSet
 	Filter ClientFilter
 
@@ -44,30 +51,59 @@ type Config struct {
 	// Defaults to NoRewrite.
 	Rewriter AddressRewriter
 
+	// SniffDomains enables extracting the TLS SNI or HTTP Host from the
+	// first bytes a client sends, when it connects to an IP address.
+	// The sniffed name is set as the FQDN of the DestAddr, and the Rules are
+	// evaluated once it is known (or SniffTimeout elapsed) rather than before dialing.
+	SniffDomains bool
+
+	// SniffTimeout is how long to wait for the first client bytes when sniffing.
+	// Defaults to 1s.
+	SniffTimeout time.Duration
+
+	// DisableSplice relays CONNECT streams through buffers, rather than
+	// with zero-copy splice(2) when the client and target are plain TCP
+	// connections
+	DisableSplice bool
+
+	// Buffers is the pool relay and datagram buffers are taken from.
+	// Defaults to bufpool.Default
+	Buffers *bufpool.Pool
+
+	// BufferSize is the size of the buffers relaying CONNECT streams,
+	// rounded up to a class of Buffers. Defaults to 4096.
+	// UDP datagrams always use buffers of up to 64K
+	BufferSize int
+
+	// UDPIdleTimeout closes the socket of an UDP association to a target,
+	// and the association itself, after no datagrams for that long.
+	// Defaults to 2 minutes
+	UDPIdleTimeout time.Duration
+
 	// BindIP is used for bind or udp associate
 	BindIP net.IP
 
-	// Detailed metrics (per-downstream)
+	// DetailedMetrics enables per-target (per-downstream) metrics
 	DetailedMetrics bool
 
+	// Metrics is where the built-in metrics are recorded.
+	// Defaults to a MemoryMetrics with default settings.
+	Metrics MetricsSink
+
 	// Logger can be used to provide a custom log target.
 	// Defaults to stdout.
 	Logger *logrus.Logger
 
 	// Optional function for dialing out
 	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
-}
 
-type NetMetrics struct {
-	Active atomic.Int64
-	Rx, Tx atomic.Int64
-}
+	// Hooks are notified of connection lifecycle events, in order,
+	// after the built-in metrics
+	Hooks []Hook
 
-type HostMetrics struct {
-	NetMetrics
-	Commands  [4]atomic.Int64
-	ActiveUDP atomic.Int64
-	LastSeen  atomic.Value
+	// AuthGuard, if set, bans client IPs and usernames after repeated
+	// authentication failures
+	AuthGuard *AuthGuard
 }
 
 // Server is reponsible for accepting connections and handling
@@ -75,9 +111,12 @@ type HostMetrics struct {
 type Server struct {
 	config      *Config
 	authMethods map[uint8]Authenticator
+	hooks       hookChain
+	ownMetrics  bool
+	listener    *ListenerMetrics
 
-	hostMetrics   *ttlcache.Cache[string, *HostMetrics]
-	targetMetrics *ttlcache.Cache[string, *NetMetrics]
+	// active UDP associations
+	associations *xsync.MapOf[*udpAssociation, struct{}]
 }
 
 // New creates a new Server and potentially returns an error
@@ -101,35 +140,46 @@ func New(conf *Config) (*Server, error) {
 		conf.Rules = PermitAll()
 	}
 
+	if conf.Buffers == nil {
+		conf.Buffers = bufpool.Default
+	}
+	if conf.BufferSize <= 0 {
+		conf.BufferSize = 4096
+	}
+
+	if conf.UDPIdleTimeout <= 0 {
+		conf.UDPIdleTimeout = 2 * time.Minute
+	}
+
+	if conf.Name == "" {
+		conf.Name = "default"
+	}
+
 	// Ensure we have a log target
 	if conf.Logger == nil {
 		conf.Logger = logrus.StandardLogger()
 	}
 
 	server := &Server{
-		config: conf,
-		hostMetrics: ttlcache.New[string, *HostMetrics](
-			ttlcache.WithTTL[string, *HostMetrics](24*time.Hour),
-			ttlcache.WithLoader[string, *HostMetrics](ttlcache.LoaderFunc[string, *HostMetrics](func(c *ttlcache.Cache[string, *HostMetrics], key string) *ttlcache.Item[string, *HostMetrics] {
-				item := c.Set(key, &HostMetrics{}, ttlcache.DefaultTTL)
-				return item
-			})),
-		),
-		targetMetrics: ttlcache.New[string, *NetMetrics](
-			ttlcache.WithTTL[string, *NetMetrics](30*time.Minute),
-			ttlcache.WithLoader[string, *NetMetrics](ttlcache.LoaderFunc[string, *NetMetrics](func(c *ttlcache.Cache[string, *NetMetrics], key string) *ttlcache.Item[string, *NetMetrics] {
-				item := c.Set(key, &NetMetrics{}, ttlcache.DefaultTTL)
-				return item
-			})),
-		),
-	}
-
-	go server.hostMetrics.Start()
-	go server.targetMetrics.Start()
+		config:       conf,
+		associations: xsync.NewMapOf[*udpAssociation, struct{}](),
+	}
+
+	// Ensure we have a metrics sink
+	if conf.Metrics == nil {
+		conf.Metrics = NewMemoryMetrics(MemoryMetricsConfig{})
+		server.ownMetrics = true
+	}
+
+	server.listener = conf.Metrics.Listener(conf.Name)
+	server.hooks = append(hookChain{&metricsHook{server: server}}, conf.Hooks...)
 
 	server.authMethods = make(map[uint8]Authenticator)
 
 	for _, a := range conf.AuthMethods {
+		if conf.AuthGuard != nil {
+			a = guardAuthenticator(a, conf.AuthGuard)
+		}
 		server.authMethods[a.GetCode()] = a
 	}
 
@@ -137,8 +187,9 @@ func New(conf *Config) (*Server, error) {
 }
 
 func (s *Server) Close() {
-	s.hostMetrics.Stop()
-	s.targetMetrics.Stop()
+	if m, ok := s.config.Metrics.(*MemoryMetrics); ok && s.ownMetrics {
+		m.Close()
+	}
 }
 
 // ListenAndServe is used to create a listener and serve on it
@@ -163,20 +214,43 @@ func (s *Server) Serve(l net.Listener) error {
 
 // ServeConn is used to serve a single connection.
 func (s *Server) ServeConn(conn net.Conn) error {
+	tlsConn, _ := conn.(*tls.Conn)
+	info := newConnInfo(conn)
+	conn = s.hooks.WrapClientConn(conn)
 	defer conn.Close()
 	bufConn := bufio.NewReader(conn)
 
 	// Check client IP against whitelist
-	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	client, err := clientAddr(conn.RemoteAddr())
 	if err != nil {
 		s.config.Logger.Errorf("socks: Failed to get client IP address: %v", err)
 		return err
 	}
-	ip := net.ParseIP(clientIP)
+	ip, clientIP := client.IP, client.IP.String()
 	if s.config.Filter != nil && !s.config.Filter.Allowed(ip) {
+		s.listener.Refused.Add(1)
 		s.config.Logger.Warnf("socks: Connection from not allowed IP address: %s", clientIP)
 		return fmt.Errorf("connection from not allowed IP address")
 	}
+	if guard := s.config.AuthGuard; guard != nil {
+		if until := guard.Banned(BanIP, ip.String()); !until.IsZero() {
+			guard.Refused.Add(1)
+			s.listener.Refused.Add(1)
+			s.config.Logger.Warnf("socks: Connection from banned IP address: %s, until %s", clientIP, until.Format(time.RFC3339))
+			return fmt.Errorf("connection from banned IP address")
+		}
+		if delay := guard.Delay(ip); delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+	if tlsConn != nil {
+		if err := handshake(tlsConn); err != nil {
+			s.config.Logger.Warnf("socks: TLS handshake with %s failed: %v", clientIP, err)
+			return err
+		}
+		info = newConnInfo(tlsConn)
+	}
+	s.hooks.OnAccept(conn)
 
 	// Read the version byte
 	version := []byte{0}
@@ -193,12 +267,20 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	}
 
 	// Authenticate the connection
-	authContext, err := s.authenticate(conn, bufConn)
+	authContext, err := s.authenticate(context.Background(), info, conn, bufConn)
 	if err != nil {
+		if s.config.AuthGuard != nil && errors.Is(err, UserAuthFailed) {
+			s.config.AuthGuard.Fail(ip, authUsername(err))
+		}
+		s.hooks.OnAuthFailure(conn, err)
 		err = fmt.Errorf("Failed to authenticate: %v", err)
 		s.config.Logger.Warnf("socks: %v", err)
 		return err
 	}
+	if s.config.AuthGuard != nil {
+		s.config.AuthGuard.Success(ip, authContext.Payload["Username"])
+	}
+	s.hooks.OnAuthSuccess(conn, authContext)
 
 	request, err := NewRequest(bufConn)
 	if err != nil {
@@ -210,9 +292,7 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return fmt.Errorf("Failed to read destination address: %v", err)
 	}
 	request.AuthContext = authContext
-	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
-	}
+	request.RemoteAddr = client
 
 	// Process the client request
 	if err := s.handleRequest(request, conn); err != nil {
@@ -224,16 +304,48 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	return nil
 }
 
+// clientAddr returns the address of a client. Clients of Unix sockets are
+// local, and seen as 127.0.0.1
+func clientAddr(addr net.Addr) (*AddrSpec, error) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return &AddrSpec{IP: addr.IP, Port: addr.Port}, nil
+	case *net.UnixAddr:
+		return &AddrSpec{IP: net.IPv4(127, 0, 0, 1)}, nil
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client IP address %q", host)
+	}
+	portNum, _ := strconv.Atoi(port)
+	return &AddrSpec{IP: ip, Port: portNum}, nil
+}
+
+// Name returns the name of the Server, see Config.Name
+func (s *Server) Name() string {
+	return s.config.Name
+}
+
 func (s *Server) RangeHostMetrics(f func(host string, m *HostMetrics)) {
-	s.hostMetrics.Range(func(item *ttlcache.Item[string, *HostMetrics]) bool {
-		f(item.Key(), item.Value())
-		return true
-	})
+	s.config.Metrics.RangeHosts(f)
 }
 
 func (s *Server) RangeTargetMetrics(f func(target string, m *NetMetrics)) {
-	s.targetMetrics.Range(func(item *ttlcache.Item[string, *NetMetrics]) bool {
-		f(item.Key(), item.Value())
-		return true
-	})
+	s.config.Metrics.RangeTargets(f)
+}
+
+func (s *Server) RangeUDPTargetMetrics(f func(target string, m *UDPMetrics)) {
+	s.config.Metrics.RangeUDPTargets(f)
+}
+
+func (s *Server) RangeRuleMetrics(f func(name string, m *RuleMetrics)) {
+	s.config.Metrics.RangeRules(f)
+}
+
+func (s *Server) RangeListenerMetrics(f func(name string, m *ListenerMetrics)) {
+	s.config.Metrics.RangeListeners(f)
 }
@@ -0,0 +1,95 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// echoServer accepts TCP connections and echoes what they send
+func echoServer(t *testing.T) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	target := echoServer(t)
+	metrics := NewMemoryMetrics(MemoryMetricsConfig{})
+	defer metrics.Close()
+
+	server, err := New(&Config{Name: "sidecar", Metrics: metrics})
+	assert.NoError(t, err)
+	assert.Equal(t, "sidecar", server.Name())
+	other, err := New(&Config{Metrics: metrics, Filter: &ClientFilterCIDR{}})
+	assert.NoError(t, err)
+	assert.Equal(t, "default", other.Name())
+
+	path := filepath.Join(t.TempDir(), "socks.sock")
+	l, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	defer l.Close()
+	go server.Serve(l)
+
+	conn, err := net.Dial("unix", path)
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := []byte{socks5Version, 1, NoAuth, socks5Version, ConnectCommand, 0, ipv4Address}
+	req = append(req, target.IP.To4()...)
+	req = append(req, byte(target.Port>>8), byte(target.Port))
+	conn.Write(req)
+
+	resp := make([]byte, 2+10)
+	_, err = io.ReadFull(conn, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{socks5Version, NoAuth, socks5Version, successReply}, resp[:4])
+
+	conn.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	_, err = io.ReadFull(conn, echo)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(echo))
+
+	sidecar := metrics.Listener("sidecar")
+	assert.EqualValues(t, 1, sidecar.Accepted.Load())
+	assert.EqualValues(t, 1, sidecar.Active.Load())
+	assert.EqualValues(t, 4, sidecar.Tx.Load())
+	assert.EqualValues(t, 4, metrics.Host("127.0.0.1").Tx.Load(), "unix socket clients are local")
+
+	// connections of the other server are counted apart
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l2.Close()
+	go other.Serve(l2)
+	refused, err := net.Dial("tcp", l2.Addr().String())
+	assert.NoError(t, err)
+	io.ReadAll(refused)
+	refused.Close()
+	assert.EqualValues(t, 1, metrics.Listener("default").Refused.Load())
+	assert.EqualValues(t, 0, sidecar.Refused.Load())
+
+	names := map[string]bool{}
+	server.RangeListenerMetrics(func(name string, m *ListenerMetrics) {
+		names[name] = true
+	})
+	assert.Equal(t, map[string]bool{"sidecar": true, "default": true}, names)
+}
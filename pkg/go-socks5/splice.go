@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// spliceChunk is how many bytes the zero-copy relay moves between two
+// OnTransfer notifications
+const spliceChunk = 64 * 1024
+
+// relay starts relaying a CONNECT stream in both directions, with zero-copy
+// splice(2) (on Linux) when the client and the target are plain TCP
+// connections, or else through pooled buffers
+func (s *Server) relay(ctx context.Context, req *Request, conn conn, target net.Conn) (tx, rx <-chan error) {
+	onTx := func(n int) {
+		s.hooks.OnTransfer(ctx, req, DirectionTx, n)
+	}
+	onRx := func(n int) {
+		s.hooks.OnTransfer(ctx, req, DirectionRx, n)
+	}
+
+	client, clientTCP := conn.(*net.TCPConn)
+	targetTCP, ok := target.(*net.TCPConn)
+	buffered, bufferedOk := req.bufConn.(*bufio.Reader)
+	if s.config.DisableSplice || !clientTCP || !ok || !bufferedOk {
+		return s.proxy(target, req.bufConn, onTx), s.proxy(conn, target, onRx)
+	}
+	return spliceProxy(targetTCP, client, buffered, onTx), spliceProxy(client, targetTCP, nil, onRx)
+}
+
+// spliceProxy is proxy between TCP connections, letting the kernel move the
+// data. Bytes src already buffered in a bufio.Reader are sent first
+func spliceProxy(dst, src *net.TCPConn, buffered *bufio.Reader, onRead func(int)) <-chan error {
+	ret := make(chan error, 1)
+	go func() {
+		defer dst.CloseWrite()
+
+		if buffered != nil && buffered.Buffered() > 0 {
+			b, _ := buffered.Peek(buffered.Buffered())
+			n, err := dst.Write(b)
+			buffered.Discard(n)
+			if n > 0 && onRead != nil {
+				onRead(n)
+			}
+			if err != nil {
+				ret <- err
+				return
+			}
+		}
+
+		// ReadFrom splices from a TCPConn, also when limited
+		limited := &io.LimitedReader{R: src}
+		for {
+			limited.N = spliceChunk
+			n, err := dst.ReadFrom(limited)
+			if n > 0 && onRead != nil {
+				onRead(int(n))
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					err = nil
+				}
+				ret <- err
+				return
+			}
+			if limited.N > 0 {
+				// src reached EOF
+				ret <- nil
+				return
+			}
+		}
+	}()
+	return ret
+}
@@ -0,0 +1,140 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"socks5-server-ng/pkg/bufpool"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	return conn.(*net.TCPConn), (<-accepted).(*net.TCPConn)
+}
+
+func TestSpliceProxy(t *testing.T) {
+	client, clientPeer := tcpPair(t)
+	target, targetPeer := tcpPair(t)
+	defer client.Close()
+	defer clientPeer.Close()
+	defer target.Close()
+	defer targetPeer.Close()
+
+	// the request was read along with the first bytes of the stream
+	client.Write([]byte("REQUEST hello "))
+	buffered := bufio.NewReader(clientPeer)
+	line, err := buffered.ReadString(' ')
+	assert.NoError(t, err)
+	assert.Equal(t, "REQUEST ", line)
+
+	var copied atomic.Int64
+	done := spliceProxy(target, clientPeer, buffered, func(n int) {
+		copied.Add(int64(n))
+	})
+
+	payload := strings.Repeat("x", 3*spliceChunk+100)
+	go func() {
+		client.Write([]byte(payload))
+		client.CloseWrite()
+	}()
+
+	received, err := io.ReadAll(targetPeer)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello "+payload, string(received), "buffered bytes are sent first")
+	assert.NoError(t, <-done)
+	assert.EqualValues(t, len(received), copied.Load())
+}
+
+func TestRelayFallback(t *testing.T) {
+	buffers := bufpool.NewPool(1, 4096, 16384)
+	server, err := New(&Config{Buffers: buffers, BufferSize: 8000})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	target, targetPeer := tcpPair(t)
+	defer target.Close()
+	defer targetPeer.Close()
+
+	// a wrapped client connection can't be spliced
+	client, clientPeer := net.Pipe()
+	defer client.Close()
+	req := &Request{bufConn: bufio.NewReader(clientPeer), RemoteAddr: &AddrSpec{IP: net.IPv4(127, 0, 0, 1)}}
+	server.hooks.OnRequest(context.Background(), req)
+
+	tx, _ := server.relay(context.Background(), req, clientPeer, target)
+	go func() {
+		client.Write([]byte("ping"))
+		client.Close()
+	}()
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(targetPeer, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("ping"), buf)
+	assert.NoError(t, <-tx)
+	assert.EqualValues(t, 4, req.hostMetrics.Tx.Load())
+	// the target to client direction is still relaying
+	assert.GreaterOrEqual(t, buffers.Class(16384).MetricLeased(), int64(1))
+	assert.EqualValues(t, 0, buffers.Class(4096).MetricMisses())
+}
+
+func benchmarkRelay(b *testing.B, disableSplice bool) {
+	server, err := New(&Config{DisableSplice: disableSplice})
+	assert.NoError(b, err)
+	defer server.Close()
+
+	client, clientPeer := tcpPair(b)
+	target, targetPeer := tcpPair(b)
+	defer client.Close()
+	defer target.Close()
+	defer targetPeer.Close()
+
+	req := &Request{bufConn: bufio.NewReader(clientPeer), RemoteAddr: &AddrSpec{IP: net.IPv4(127, 0, 0, 1)}}
+	server.hooks.OnRequest(context.Background(), req)
+	tx, _ := server.relay(context.Background(), req, clientPeer, target)
+
+	chunk := bytes.Repeat([]byte("x"), 1<<20)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	usage := startCPUUsage()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			client.Write(chunk)
+		}
+		client.CloseWrite()
+	}()
+	n, _ := io.Copy(io.Discard, targetPeer)
+
+	b.StopTimer()
+	usage.report(b)
+	<-tx
+	if n != int64(b.N*len(chunk)) {
+		b.Fatalf("relayed %d bytes, expected %d", n, b.N*len(chunk))
+	}
+}
+
+func BenchmarkRelayBuffered(b *testing.B) {
+	benchmarkRelay(b, true)
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	benchmarkRelay(b, false)
+}
@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake of clients
+const tlsHandshakeTimeout = 10 * time.Second
+
+var NoClientCert = fmt.Errorf("No verified client certificate")
+
+// ClientCertAuthenticator authenticates TLS clients with their verified
+// certificate, without a password. It is negotiated as the "No Authentication"
+// method, the identity of the certificate (see CertIdentity) being the
+// Username of the AuthContext.
+// Clients without a verified certificate are offered the other methods.
+type ClientCertAuthenticator struct{}
+
+func (a ClientCertAuthenticator) GetCode() uint8 {
+	return NoAuth
+}
+
+func (a ClientCertAuthenticator) Available(info *ConnInfo) bool {
+	cert := info.ClientCertificate()
+	return cert != nil && CertIdentity(cert) != ""
+}
+
+func (a ClientCertAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	return a.AuthenticateConn(context.Background(), newConnInfo(writer), reader, writer)
+}
+
+func (a ClientCertAuthenticator) AuthenticateConn(ctx context.Context, info *ConnInfo, reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	cert := info.ClientCertificate()
+	if cert == nil || CertIdentity(cert) == "" {
+		writer.Write([]byte{socks5Version, noAcceptable})
+		return nil, NoClientCert
+	}
+	if _, err := writer.Write([]byte{socks5Version, NoAuth}); err != nil {
+		return nil, err
+	}
+	return &AuthContext{NoAuth, map[string]string{
+		"Username":    CertIdentity(cert),
+		"CertSubject": cert.Subject.String(),
+	}}, nil
+}
+
+// ClientCertificate returns the verified certificate of a TLS client, or nil
+func (c *ConnInfo) ClientCertificate() *x509.Certificate {
+	if c == nil || c.TLS == nil || len(c.TLS.VerifiedChains) == 0 || len(c.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return c.TLS.VerifiedChains[0][0]
+}
+
+// CertIdentity returns the identity of a client certificate: its common name,
+// or else its first DNS, email or URI subject alternative name
+func CertIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// ListenAndServeTLS is used to create a TLS listener and serve on it.
+// Use GetCertificate or GetConfigForClient in config to reload certificates
+func (s *Server) ListenAndServeTLS(network, addr string, config *tls.Config) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(tls.NewListener(l, config))
+}
+
+// handshake completes the TLS handshake of a client, so that its state is
+// known before authentication
+func handshake(conn *tls.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	return conn.HandshakeContext(ctx)
+}
@@ -0,0 +1,155 @@
+package socks5
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert, key, pool}
+}
+
+// issue creates a certificate for tmpl, signed by the CA
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertIdentity(t *testing.T) {
+	u, _ := url.Parse("spiffe://example.com/alice")
+	assert.Equal(t, "alice", CertIdentity(&x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, DNSNames: []string{"a.example.com"}}))
+	assert.Equal(t, "a.example.com", CertIdentity(&x509.Certificate{DNSNames: []string{"a.example.com"}}))
+	assert.Equal(t, "alice@example.com", CertIdentity(&x509.Certificate{EmailAddresses: []string{"alice@example.com"}}))
+	assert.Equal(t, "spiffe://example.com/alice", CertIdentity(&x509.Certificate{URIs: []*url.URL{u}}))
+	assert.Equal(t, "", CertIdentity(&x509.Certificate{}))
+}
+
+type authHook struct {
+	NopHook
+	auth chan *AuthContext
+}
+
+func (h authHook) OnAuthSuccess(conn net.Conn, auth *AuthContext) {
+	h.auth <- auth
+}
+
+func TestServeTLSClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	hook := authHook{auth: make(chan *AuthContext, 1)}
+	server, err := New(&Config{
+		AuthMethods: []Authenticator{
+			ClientCertAuthenticator{},
+			UserPassAuthenticator{StaticCredentials{"bob": "secret"}},
+		},
+		Hooks: []Hook{hook},
+	})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go server.Serve(tls.NewListener(l, &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, &x509.Certificate{
+			DNSNames:    []string{"localhost"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})},
+		ClientCAs:  ca.pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}))
+
+	dial := func(certs ...tls.Certificate) *tls.Conn {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			RootCAs:      ca.pool,
+			ServerName:   "localhost",
+			Certificates: certs,
+		})
+		assert.NoError(t, err)
+		return conn
+	}
+
+	// with a certificate, no password is needed
+	conn := dial(ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}))
+	conn.Write([]byte{socks5Version, 1, NoAuth})
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(conn, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{socks5Version, NoAuth}, resp)
+	auth := <-hook.auth
+	assert.Equal(t, NoAuth, auth.Method)
+	assert.Equal(t, "alice", auth.Payload["Username"])
+	assert.Equal(t, "CN=alice", auth.Payload["CertSubject"])
+	conn.Close()
+
+	// without a certificate, "no authentication" is refused
+	conn = dial()
+	conn.Write([]byte{socks5Version, 1, NoAuth})
+	resp, _ = io.ReadAll(conn)
+	assert.Equal(t, []byte{socks5Version, noAcceptable}, resp)
+	conn.Close()
+
+	// but passwords still work
+	conn = dial()
+	conn.Write([]byte{socks5Version, 1, UserPassAuth, userAuthVersion, 3, 'b', 'o', 'b', 6, 's', 'e', 'c', 'r', 'e', 't'})
+	resp = make([]byte, 4)
+	_, err = io.ReadFull(conn, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{socks5Version, UserPassAuth, userAuthVersion, authSuccess}, resp)
+	assert.Equal(t, "bob", (<-hook.auth).Payload["Username"])
+	conn.Close()
+
+	// including when "no authentication" is offered first
+	conn = dial()
+	conn.Write([]byte{socks5Version, 2, NoAuth, UserPassAuth, userAuthVersion, 3, 'b', 'o', 'b', 6, 's', 'e', 'c', 'r', 'e', 't'})
+	resp = make([]byte, 4)
+	_, err = io.ReadFull(conn, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{socks5Version, UserPassAuth, userAuthVersion, authSuccess}, resp)
+	assert.Equal(t, "bob", (<-hook.auth).Payload["Username"])
+	conn.Close()
+}
@@ -0,0 +1,469 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/puzpuzpuz/xsync/v3"
+)
+
+const (
+	// udpBufferSize fits any UDP datagram, with its SOCKS header
+	udpBufferSize = 64 * 1024
+)
+
+var (
+	errShortUDPHeader   = errors.New("UDP datagram shorter than its header")
+	errUDPFragmentation = errors.New("UDP datagram fragmentation is not supported")
+	errUDPFrameTooLarge = errors.New("UDP datagram too large for its frame")
+)
+
+// readUDPHeader parses the SOCKS header of an UDP datagram, returning its
+// target and the length of the header
+func readUDPHeader(datagram []byte) (*AddrSpec, int, error) {
+	// RSV, FRAG & ATYP
+	if len(datagram) < 4 {
+		return nil, 0, errShortUDPHeader
+	}
+	if datagram[2] != 0 {
+		return nil, 0, errUDPFragmentation
+	}
+
+	reader := bytes.NewReader(datagram[3:])
+	target, err := readAddrSpec(reader)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errShortUDPHeader
+		}
+		return nil, 0, err
+	}
+	return target, len(datagram) - reader.Len(), nil
+}
+
+// UDPAssociation describes an active UDP association
+type UDPAssociation struct {
+	// Listener is the name of the Server, see Config.Name
+	Listener string
+	// Client is the address of the client which requested the association
+	Client *AddrSpec
+	// Relay is the address of the socket the client sends datagrams to
+	Relay   net.Addr
+	Started time.Time
+	// Targets is how many targets have an open socket
+	Targets int
+	// Metrics counts the datagrams of the association
+	Metrics *UDPMetrics
+}
+
+// RangeUDPAssociations calls f with each active UDP association
+func (s *Server) RangeUDPAssociations(f func(a UDPAssociation)) {
+	s.associations.Range(func(a *udpAssociation, _ struct{}) bool {
+		f(UDPAssociation{
+			Listener: s.config.Name,
+			Client:   a.req.RemoteAddr,
+			Relay:    a.relay,
+			Started:  a.started,
+			Targets:  a.targets.Size(),
+			Metrics:  &a.metrics,
+		})
+		return true
+	})
+}
+
+// count records a datagram of n bytes relayed in the given direction
+func (m *UDPMetrics) count(dir Direction, n int) {
+	if m == nil {
+		return
+	}
+	if dir == DirectionRx {
+		m.RxPackets.Add(1)
+		m.Rx.Add(int64(n))
+	} else {
+		m.TxPackets.Add(1)
+		m.Tx.Add(int64(n))
+	}
+}
+
+// readUDPFrame reads a datagram prefixed by its length into buf, see
+// UDPTunnelCommand
+func readUDPFrame(r io.Reader, buf []byte) (int, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(length[:]))
+	if n > len(buf) {
+		return 0, errUDPFrameTooLarge
+	}
+	return io.ReadFull(r, buf[:n])
+}
+
+// writeUDPFrame writes a datagram, made of parts, prefixed by its length
+func writeUDPFrame(w io.Writer, parts ...[]byte) error {
+	n := 0
+	for _, part := range parts {
+		n += len(part)
+	}
+	if n > 0xFFFF {
+		return errUDPFrameTooLarge
+	}
+	length := [2]byte{byte(n >> 8), byte(n)}
+	bufs := append(net.Buffers{length[:]}, parts...)
+	_, err := bufs.WriteTo(w)
+	return err
+}
+
+// udpAssociation relays the datagrams of a client to its targets, each
+// through its own socket, and the replies back with reply
+type udpAssociation struct {
+	server  *Server
+	ctx     context.Context
+	req     *Request
+	relay   net.Addr
+	started time.Time
+	reply   func(datagram []byte) error
+	targets *xsync.MapOf[string, *udpTarget]
+	metrics UDPMetrics
+
+	// last datagram in either direction, in UnixNano
+	lastActive atomic.Int64
+}
+
+// udpTarget is the socket of an association to one target
+type udpTarget struct {
+	net.Conn
+	key        string
+	header     []byte      // SOCKS header of the datagrams to the client
+	metrics    *UDPMetrics // nil unless DetailedMetrics
+	lastActive atomic.Int64
+	closed     atomic.Bool
+}
+
+func (s *Server) newUDPAssociation(ctx context.Context, req *Request, relay net.Addr, reply func(datagram []byte) error) *udpAssociation {
+	a := &udpAssociation{
+		server:  s,
+		ctx:     ctx,
+		req:     req,
+		relay:   relay,
+		started: time.Now(),
+		reply:   reply,
+		targets: xsync.NewMapOf[string, *udpTarget](),
+	}
+	a.lastActive.Store(a.started.UnixNano())
+	s.associations.Store(a, struct{}{})
+	return a
+}
+
+// closeWhenIdle closes c once no datagram was relayed for UDPIdleTimeout.
+// The returned function stops watching
+func (a *udpAssociation) closeWhenIdle(c io.Closer) (stop func()) {
+	idle := a.server.config.UDPIdleTimeout
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(idle)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+			if left := idle - time.Since(time.Unix(0, a.lastActive.Load())); left > 0 {
+				timer.Reset(left)
+				continue
+			}
+			a.server.config.Logger.Infof("%s UDP association idle for %s", a.req.RemoteAddr, idle)
+			c.Close()
+			return
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// targetMetrics returns the metrics of a target, if tracked
+func (a *udpAssociation) targetMetrics(target *AddrSpec) *UDPMetrics {
+	if !a.server.config.DetailedMetrics {
+		return nil
+	}
+	return a.server.config.Metrics.UDPTarget(target.FqdnOrIP())
+}
+
+// drop counts a datagram which wasn't relayed
+func (a *udpAssociation) drop(target *UDPMetrics) {
+	a.metrics.Drops.Add(1)
+	if target != nil {
+		target.Drops.Add(1)
+	}
+}
+
+// fail counts a failed dial, read or write
+func (a *udpAssociation) fail(target *UDPMetrics) {
+	a.metrics.Errors.Add(1)
+	if target != nil {
+		target.Errors.Add(1)
+	}
+}
+
+// idle returns whether no datagram was relayed for UDPIdleTimeout
+func (a *udpAssociation) idle() bool {
+	return time.Since(time.Unix(0, a.lastActive.Load())) >= a.server.config.UDPIdleTimeout
+}
+
+// send relays the data of a datagram to its target, opening a socket to
+// the target first if the rules allow it
+func (a *udpAssociation) send(header []byte, targetAddr *AddrSpec, data []byte) error {
+	s := a.server
+	key := targetAddr.String()
+	target, ok := a.targets.Load(key)
+	if !ok {
+		// resolved like the destination of a request, for the rules to
+		// check its IP, and to dial it
+		if targetAddr.FQDN != "" {
+			ip, err := s.config.Resolver.Resolve(a.ctx, targetAddr.FQDN)
+			if err != nil {
+				a.fail(a.targetMetrics(targetAddr))
+				return fmt.Errorf("Failed to resolve UDP target '%v': %v", targetAddr.FQDN, err)
+			}
+			targetAddr.IP = ip
+		}
+		targetReq := &Request{
+			Version:     a.req.Version,
+			Command:     a.req.Command,
+			AuthContext: a.req.AuthContext,
+			RemoteAddr:  a.req.RemoteAddr,
+			DestAddr:    targetAddr,
+			Datagram:    true,
+		}
+		if d := s.evaluate(a.ctx, targetReq); d.Verdict == VerdictDeny {
+			a.drop(a.targetMetrics(targetAddr))
+			return fmt.Errorf("UDP target %s blocked, %v", targetAddr, d)
+		}
+
+		metrics := a.targetMetrics(targetAddr)
+		conn, err := s.dial(a.ctx, a.req, "udp", targetAddr.Address())
+		if err != nil {
+			a.fail(metrics)
+			return err
+		}
+		target = &udpTarget{
+			Conn:    conn,
+			key:     key,
+			header:  append([]byte(nil), header...),
+			metrics: metrics,
+		}
+		if metrics != nil {
+			metrics.Active.Add(1)
+		}
+		a.targets.Store(key, target)
+		s.config.Logger.Debugf("New UDP target %s for %s", targetAddr.Address(), a.req.RemoteAddr)
+
+		go a.receive(target)
+	}
+
+	now := time.Now().UnixNano()
+	target.lastActive.Store(now)
+	a.lastActive.Store(now)
+
+	if _, err := target.Write(data); err != nil {
+		a.fail(target.metrics)
+		a.closeTarget(target)
+		return err
+	}
+	s.hooks.OnTransfer(a.ctx, a.req, DirectionTx, len(data))
+	a.metrics.count(DirectionTx, len(data))
+	target.metrics.count(DirectionTx, len(data))
+	return nil
+}
+
+// receive relays the datagrams of a target back to the client, until the
+// target is idle for UDPIdleTimeout or closed
+func (a *udpAssociation) receive(target *udpTarget) {
+	s := a.server
+	defer a.closeTarget(target)
+
+	// the header and payload fit in the 64K class: a reply larger than that
+	// couldn't be sent to the client in a datagram anyway
+	buf := s.config.Buffers.Get(udpBufferSize)
+	defer s.config.Buffers.Return(buf)
+	copy(buf, target.header)
+
+	idle := s.config.UDPIdleTimeout
+	for {
+		target.SetReadDeadline(time.Now().Add(idle))
+		n, err := target.Read(buf[len(target.header):])
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if time.Since(time.Unix(0, target.lastActive.Load())) < idle {
+				continue
+			}
+			s.config.Logger.Debugf("UDP target %s for %s idle", target.key, a.req.RemoteAddr)
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				a.fail(target.metrics)
+			}
+			return
+		}
+
+		now := time.Now().UnixNano()
+		target.lastActive.Store(now)
+		a.lastActive.Store(now)
+
+		if err := a.reply(buf[:len(target.header)+n]); err != nil {
+			a.fail(target.metrics)
+			return
+		}
+		s.hooks.OnTransfer(a.ctx, a.req, DirectionRx, n)
+		a.metrics.count(DirectionRx, n)
+		target.metrics.count(DirectionRx, n)
+	}
+}
+
+func (a *udpAssociation) closeTarget(target *udpTarget) {
+	if !target.closed.CompareAndSwap(false, true) {
+		return
+	}
+	// a target re-opened meanwhile stays
+	a.targets.Compute(target.key, func(old *udpTarget, loaded bool) (*udpTarget, bool) {
+		return old, !loaded || old == target
+	})
+	target.Close()
+	if target.metrics != nil {
+		target.metrics.Active.Add(-1)
+	}
+	a.server.config.Logger.Debugf("Closed UDP target %s for %s", target.key, a.req.RemoteAddr)
+}
+
+// close closes the sockets to every target, and ends the association
+func (a *udpAssociation) close() {
+	a.targets.Range(func(key string, target *udpTarget) bool {
+		a.closeTarget(target)
+		return true
+	})
+	a.server.associations.Delete(a)
+}
+
+// handleAssociateConnection relays the datagrams the client sends to the
+// socket of an association. It returns once the socket is closed, or no
+// datagram was relayed for UDPIdleTimeout
+func (s *Server) handleAssociateConnection(ctx context.Context, req *Request, sock *net.UDPConn) {
+	// The declared port, when not zero, or else the port of the first
+	// datagram, from the IP of the client
+	client := &net.UDPAddr{IP: req.RemoteAddr.IP, Port: req.DestAddr.Port}
+
+	a := s.newUDPAssociation(ctx, req, sock.LocalAddr(), func(datagram []byte) error {
+		_, err := sock.WriteToUDP(datagram, client)
+		return err
+	})
+	defer a.close()
+
+	buf := s.config.Buffers.Get(udpBufferSize)
+	defer s.config.Buffers.Return(buf)
+
+	for {
+		sock.SetReadDeadline(time.Now().Add(s.config.UDPIdleTimeout))
+		n, srcAddr, err := sock.ReadFromUDP(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if !a.idle() {
+				continue
+			}
+			s.config.Logger.Infof("%s UDP association idle for %s", req.RemoteAddr, s.config.UDPIdleTimeout)
+			return
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		// Check the datagram is from the client
+		if !srcAddr.IP.Equal(client.IP) || (client.Port != 0 && srcAddr.Port != client.Port) {
+			s.config.Logger.Warnf("UDP Source packet (%s) is not expected (%s)", srcAddr, client)
+			a.drop(nil)
+			continue
+		}
+		if client.Port == 0 {
+			client.Port = srcAddr.Port
+		}
+
+		targetAddr, headerLen, err := readUDPHeader(buf[:n])
+		if err != nil {
+			s.config.Logger.Warnf("Malformed UDP datagram from %s: %v", srcAddr, err)
+			a.drop(nil)
+			continue
+		}
+
+		if err := a.send(buf[:headerLen], targetAddr, buf[headerLen:n]); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.config.Logger.Debugf("UDP datagram from %s to %s dropped: %v", srcAddr, targetAddr, err)
+			}
+		}
+	}
+}
+
+// handleUDPTunnel is used to handle an association whose datagrams are
+// relayed over the connection, see UDPTunnelCommand
+func (s *Server) handleUDPTunnel(ctx context.Context, conn conn, req *Request) error {
+	// Check if this is allowed
+	d := s.evaluate(ctx, req)
+	if d.Verdict == VerdictDeny {
+		if err := sendReply(conn, d.reply(), nil); err != nil {
+			return fmt.Errorf("Failed to send reply: %v", err)
+		}
+		return fmt.Errorf("UDP tunnel blocked, %v", d)
+	}
+	defer s.closeAt(d.Until, req, conn)()
+
+	s.config.Logger.Infof("%s UDP tunnel", req.RemoteAddr)
+	if err := sendReply(conn, successReply, nil); err != nil {
+		return fmt.Errorf("Failed to send reply: %v", err)
+	}
+
+	// Replies of several targets are written concurrently
+	var mu sync.Mutex
+	a := s.newUDPAssociation(ctx, req, nil, func(datagram []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return writeUDPFrame(conn, datagram)
+	})
+	defer a.close()
+	defer a.closeWhenIdle(conn)()
+
+	buf := s.config.Buffers.Get(udpBufferSize)
+	defer s.config.Buffers.Return(buf)
+
+	for {
+		n, err := readUDPFrame(req.bufConn, buf)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		targetAddr, headerLen, err := readUDPHeader(buf[:n])
+		if err != nil {
+			s.config.Logger.Warnf("Malformed UDP datagram from %s: %v", req.RemoteAddr, err)
+			a.drop(nil)
+			continue
+		}
+
+		if err := a.send(buf[:headerLen], targetAddr, buf[headerLen:n]); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.config.Logger.Debugf("UDP datagram from %s to %s dropped: %v", req.RemoteAddr, targetAddr, err)
+			}
+		}
+	}
+}
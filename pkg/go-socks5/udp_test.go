@@ -0,0 +1,328 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"socks5-server-ng/pkg/bufpool"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// udpEchoServer echoes the datagrams it receives
+func udpEchoServer(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// associate opens an UDP association, declaring the client address, and
+// returns the control connection and the address to send datagrams to
+func associate(t *testing.T, server *Server, declared *net.UDPAddr) (net.Conn, *net.UDPAddr) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := []byte{socks5Version, 1, NoAuth, socks5Version, AssociateCommand, 0, ipv4Address}
+	req = append(req, declared.IP.To4()...)
+	req = append(req, byte(declared.Port>>8), byte(declared.Port))
+	conn.Write(req)
+
+	resp := make([]byte, 2+3)
+	_, err = io.ReadFull(conn, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{socks5Version, NoAuth, socks5Version, successReply}, resp[:4])
+	bind, err := readAddrSpec(conn)
+	assert.NoError(t, err)
+	return conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: bind.Port}
+}
+
+func udpDatagram(target *net.UDPAddr, data []byte) []byte {
+	datagram := []byte{0, 0, 0, ipv4Address}
+	datagram = append(datagram, target.IP.To4()...)
+	datagram = append(datagram, byte(target.Port>>8), byte(target.Port))
+	return append(datagram, data...)
+}
+
+func TestReadUDPHeader(t *testing.T) {
+	target, n, err := readUDPHeader([]byte{0, 0, 0, ipv4Address, 10, 0, 0, 1, 0, 53, 'x'})
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, "10.0.0.1:53", target.Address())
+
+	target, n, err = readUDPHeader([]byte{0, 0, 0, fqdnAddress, 3, 'f', 'o', 'o', 0, 53})
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, "foo:53", target.Address())
+
+	_, _, err = readUDPHeader([]byte{0, 0, 0})
+	assert.ErrorIs(t, err, errShortUDPHeader)
+	_, _, err = readUDPHeader([]byte{0, 0, 0, ipv4Address, 10, 0})
+	assert.ErrorIs(t, err, errShortUDPHeader)
+	_, _, err = readUDPHeader([]byte{0, 0, 0, fqdnAddress, 10, 'f', 'o', 'o'})
+	assert.ErrorIs(t, err, errShortUDPHeader)
+	_, _, err = readUDPHeader([]byte{0, 0, 1, ipv4Address, 10, 0, 0, 1, 0, 53})
+	assert.ErrorIs(t, err, errUDPFragmentation)
+	_, _, err = readUDPHeader([]byte{0, 0, 0, 9, 10, 0, 0, 1, 0, 53})
+	assert.ErrorIs(t, err, unrecognizedAddrType)
+}
+
+func TestAssociateDeclaredPort(t *testing.T) {
+	target := udpEchoServer(t)
+	server, err := New(&Config{DetailedMetrics: true})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer client.Close()
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer other.Close()
+
+	conn, relay := associate(t, server, client.LocalAddr().(*net.UDPAddr))
+
+	// datagrams from another port are dropped, and malformed ones skipped
+	other.WriteToUDP(udpDatagram(target, []byte("other")), relay)
+	client.WriteToUDP([]byte{0, 0, 0, ipv4Address, 127}, relay)
+
+	// a datagram larger than the pooled buffers of TCP
+	data := bytes.Repeat([]byte("x"), 60000)
+	_, err = client.WriteToUDP(udpDatagram(target, data), relay)
+	assert.NoError(t, err)
+
+	buf := make([]byte, 65535)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := client.ReadFromUDP(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, udpDatagram(target, data), buf[:n])
+
+	other.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = other.ReadFromUDP(buf)
+	assert.Error(t, err, "no reply to an unexpected source")
+
+	var associations []UDPAssociation
+	server.RangeUDPAssociations(func(a UDPAssociation) {
+		associations = append(associations, a)
+	})
+	assert.Len(t, associations, 1)
+	assert.Equal(t, relay.Port, associations[0].Relay.(*net.UDPAddr).Port)
+	assert.Equal(t, 1, associations[0].Targets)
+	m := associations[0].Metrics
+	assert.EqualValues(t, 2, m.Drops.Load())
+	assert.EqualValues(t, 1, m.TxPackets.Load())
+	assert.EqualValues(t, 1, m.RxPackets.Load())
+	assert.EqualValues(t, 60000, m.Rx.Load())
+
+	targets := map[string]*UDPMetrics{}
+	server.RangeUDPTargetMetrics(func(target string, m *UDPMetrics) {
+		targets[target] = m
+	})
+	assert.Len(t, targets, 1)
+	tm := targets["127.0.0.1"]
+	assert.EqualValues(t, 1, tm.Active.Load())
+	assert.EqualValues(t, 60000, tm.Tx.Load())
+	assert.EqualValues(t, 1, tm.RxPackets.Load())
+
+	// the association ends with its control connection
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		count := 0
+		server.RangeUDPAssociations(func(a UDPAssociation) { count++ })
+		return count == 0 && tm.Active.Load() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestAssociateIdleTimeout(t *testing.T) {
+	target := udpEchoServer(t)
+	server, err := New(&Config{UDPIdleTimeout: 200 * time.Millisecond})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	// the first datagram fixes an undeclared port
+	conn, relay := associate(t, server, &net.UDPAddr{IP: net.IPv4zero})
+	client.WriteToUDP(udpDatagram(target, []byte("ping")), relay)
+	buf := make([]byte, 64)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := client.ReadFromUDP(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf[10:n]))
+
+	// the server closes the control connection of an idle association
+	start := time.Now()
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+// denyDatagramPort denies the datagrams to a port
+type denyDatagramPort int
+
+func (p denyDatagramPort) Allow(ctx context.Context, req *Request) bool {
+	return !req.Datagram || req.DestAddr.Port != int(p)
+}
+
+func TestUDPTunnel(t *testing.T) {
+	target := udpEchoServer(t)
+	blocked := udpEchoServer(t)
+	server, err := New(&Config{
+		Credentials:     StaticCredentials{"user": "pass"},
+		Rules:           denyDatagramPort(blocked.Port),
+		DetailedMetrics: true,
+	})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go server.Serve(l)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = DialUDPTunnel(ctx, "tcp", l.Addr().String(), "user", "wrong")
+	assert.ErrorIs(t, err, UserAuthFailed)
+
+	tunnel, err := DialUDPTunnel(ctx, "tcp", l.Addr().String(), "user", "pass")
+	assert.NoError(t, err)
+	defer tunnel.Close()
+	tunnel.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// datagrams to blocked targets are dropped
+	_, err = tunnel.WriteTo([]byte("blocked"), blocked)
+	assert.NoError(t, err)
+
+	data := bytes.Repeat([]byte("x"), 60000)
+	n, err := tunnel.WriteTo(data, target)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), n)
+
+	buf := make([]byte, 65535)
+	n, from, err := tunnel.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, data, buf[:n])
+	assert.Equal(t, target.String(), from.String())
+
+	var associations []UDPAssociation
+	server.RangeUDPAssociations(func(a UDPAssociation) {
+		associations = append(associations, a)
+	})
+	assert.Len(t, associations, 1)
+	assert.Nil(t, associations[0].Relay)
+	assert.EqualValues(t, 1, associations[0].Metrics.Drops.Load())
+	assert.EqualValues(t, 1, associations[0].Metrics.RxPackets.Load())
+	assert.EqualValues(t, 1, server.config.Metrics.Host("127.0.0.1").ActiveUDP.Load())
+}
+
+func TestUDPTunnelIdleTimeout(t *testing.T) {
+	server, err := New(&Config{UDPIdleTimeout: 100 * time.Millisecond})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go server.Serve(l)
+
+	tunnel, err := DialUDPTunnel(context.Background(), "tcp", l.Addr().String(), "", "")
+	assert.NoError(t, err)
+	defer tunnel.Close()
+	tunnel.SetDeadline(time.Now().Add(5 * time.Second))
+
+	start := time.Now()
+	_, _, err = tunnel.ReadFrom(make([]byte, 16))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+// denyDatagramCIDR denies the datagrams to a network
+type denyDatagramCIDR string
+
+func (c denyDatagramCIDR) Allow(ctx context.Context, req *Request) bool {
+	_, cidr, _ := net.ParseCIDR(string(c))
+	return !req.Datagram || req.DestAddr.IP == nil || !cidr.Contains(req.DestAddr.IP)
+}
+
+func TestAssociateResolvesTargets(t *testing.T) {
+	target := udpEchoServer(t)
+	port := strconv.Itoa(target.Port)
+	resolver := stubResolver{"echo.test": "127.0.0.1", "internal.test": "127.0.0.2"}
+	server, addr := serve(t, &Config{Resolver: resolver, Rules: denyDatagramCIDR("127.0.0.2/32")})
+
+	pc, err := (&Dialer{ProxyAddress: addr}).ListenPacket(context.Background())
+	assert.NoError(t, err)
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// host names are resolved by the Resolver, and their IP checked
+	pc.WriteTo([]byte("internal"), fqdnAddr(net.JoinHostPort("internal.test", port)))
+	pc.WriteTo([]byte("unknown"), fqdnAddr(net.JoinHostPort("unknown.test", port)))
+	_, err = pc.WriteTo([]byte("ping"), fqdnAddr(net.JoinHostPort("echo.test", port)))
+	assert.NoError(t, err)
+
+	buf := make([]byte, 16)
+	n, from, err := pc.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf[:n]))
+	assert.Equal(t, "echo.test:"+port, from.String())
+
+	var associations []UDPAssociation
+	server.RangeUDPAssociations(func(a UDPAssociation) {
+		associations = append(associations, a)
+	})
+	assert.Len(t, associations, 1)
+	assert.EqualValues(t, 1, associations[0].Metrics.Drops.Load())
+	assert.EqualValues(t, 1, associations[0].Metrics.Errors.Load())
+}
+
+func TestAssociatePooledBuffers(t *testing.T) {
+	target := udpEchoServer(t)
+	// a header of over 29 bytes, which the largest datagram doesn't leave room for
+	longName := "a-rather-long-name-for-an-echo-target.test"
+	buffers := bufpool.NewPool(4, 4096, udpBufferSize)
+	_, addr := serve(t, &Config{Resolver: stubResolver{longName: "127.0.0.1"}, Buffers: buffers})
+
+	pc, err := (&Dialer{ProxyAddress: addr}).ListenPacket(context.Background())
+	assert.NoError(t, err)
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(5 * time.Second))
+	ping := func(to net.Addr) {
+		_, err := pc.WriteTo([]byte("ping"), to)
+		assert.NoError(t, err)
+		n, _, err := pc.ReadFrom(make([]byte, 16))
+		assert.NoError(t, err)
+		assert.Equal(t, 4, n)
+	}
+
+	// the receive buffers of targets are pooled, whatever their header
+	ping(target)
+	leased := buffers.Class(udpBufferSize).MetricLeased()
+	ping(fqdnAddr(net.JoinHostPort(longName, strconv.Itoa(target.Port))))
+	assert.Equal(t, leased+1, buffers.Class(udpBufferSize).MetricLeased())
+}
@@ -0,0 +1,195 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// WebhookRequest is the JSON body POSTed by the WebhookStore
+type WebhookRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ClientIP string `json:"client_ip,omitempty"`
+}
+
+// WebhookResponse is the JSON response expected from the webhook.
+// Attributes are added to the AuthContext Payload, lists being joined
+// with commas, eg.
+//
+//	{"allow": true, "attributes": {"Groups": ["dev", "ops"], "bandwidth": "10M"}}
+type WebhookResponse struct {
+	Allow      bool                   `json:"allow"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// WebhookConfig configures a WebhookStore
+type WebhookConfig struct {
+	// URL the credentials are POSTed to
+	URL string
+	// Header is added to webhook requests, eg. an Authorization header
+	Header http.Header
+	// Timeout of webhook requests. Defaults to 5s
+	Timeout time.Duration
+	// CacheTTL is how long an allowed login is cached. 0 disables the cache.
+	// Denials aren't cached
+	CacheTTL time.Duration
+	// Client is used for webhook requests. Defaults to an http.Client
+	Client *http.Client
+}
+
+// WebhookStore is a CredentialVerifier asking an HTTP service.
+// The webhook responds 200 with a WebhookResponse; 401 and 403 are denials,
+// other statuses are errors which fail authentication.
+type WebhookStore struct {
+	conf  WebhookConfig
+	cache *ttlcache.Cache[[sha256.Size]byte, map[string]string]
+}
+
+var _ CredentialVerifier = &WebhookStore{}
+
+// NewWebhookStore creates a WebhookStore, and starts its cache expiration
+// routine if caching is enabled
+func NewWebhookStore(conf WebhookConfig) *WebhookStore {
+	if conf.Timeout <= 0 {
+		conf.Timeout = 5 * time.Second
+	}
+	if conf.Client == nil {
+		conf.Client = &http.Client{}
+	}
+
+	a := &WebhookStore{conf: conf}
+	if conf.CacheTTL > 0 {
+		a.cache = ttlcache.New[[sha256.Size]byte, map[string]string](
+			ttlcache.WithTTL[[sha256.Size]byte, map[string]string](conf.CacheTTL),
+			ttlcache.WithDisableTouchOnHit[[sha256.Size]byte, map[string]string](),
+		)
+		go a.cache.Start()
+	}
+	return a
+}
+
+// Close stops the cache expiration routine
+func (a *WebhookStore) Close() {
+	if a.cache != nil {
+		a.cache.Stop()
+	}
+}
+
+func (a *WebhookStore) Valid(user, password string) bool {
+	_, err := a.Verify(context.Background(), nil, user, password)
+	return err == nil
+}
+
+// Verify asks the webhook, or the cache, whether the credentials are valid,
+// and returns the attributes of the user
+func (a *WebhookStore) Verify(ctx context.Context, info *ConnInfo, user, password string) (map[string]string, error) {
+	req := WebhookRequest{
+		Username: user,
+		Password: password,
+	}
+	if ip := info.ClientIP(); ip != nil {
+		req.ClientIP = ip.String()
+	}
+
+	var key [sha256.Size]byte
+	if a.cache != nil {
+		key = sha256.Sum256([]byte(req.Username + "\x00" + req.Password + "\x00" + req.ClientIP))
+		if item := a.cache.Get(key); item != nil {
+			return item.Value(), nil
+		}
+	}
+
+	resp, err := a.call(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("auth webhook: %v", err)
+	}
+	if !resp.Allow {
+		return nil, UserAuthFailed
+	}
+
+	attrs := make(map[string]string, len(resp.Attributes))
+	for k, v := range resp.Attributes {
+		attrs[k] = attributeString(v)
+	}
+	if a.cache != nil {
+		a.cache.Set(key, attrs, ttlcache.DefaultTTL)
+	}
+	return attrs, nil
+}
+
+func (a *WebhookStore) call(ctx context.Context, req WebhookRequest) (*WebhookResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.conf.Timeout)
+	defer cancel()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range a.conf.Header {
+		httpReq.Header[k] = v
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := a.conf.Client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	switch httpResp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &WebhookResponse{}, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s", httpResp.Status)
+	}
+
+	var resp WebhookResponse
+	if err := json.NewDecoder(io.LimitReader(httpResp.Body, 1<<20)).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	return &resp, nil
+}
+
+// attributeString converts a JSON value into a Payload value
+func attributeString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, item := range v {
+			values[i] = attributeString(item)
+		}
+		return strings.Join(values, ",")
+	case map[string]interface{}:
+		values := make([]string, 0, len(v))
+		for k, item := range v {
+			values = append(values, k+"="+attributeString(item))
+		}
+		sort.Strings(values)
+		return strings.Join(values, ",")
+	}
+	return fmt.Sprint(v)
+}
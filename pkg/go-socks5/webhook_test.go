@@ -0,0 +1,103 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestWebhook(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	var calls atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+		var req WebhookRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		switch {
+		case req.Username == "slow":
+			time.Sleep(100 * time.Millisecond)
+		case req.Username == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case req.Password != "secret":
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(WebhookResponse{
+			Allow: true,
+			Attributes: map[string]interface{}{
+				"groups":    []string{"dev", "ops"},
+				"bandwidth": 10,
+				"client_ip": req.ClientIP,
+			},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func userPassRequest(user, pass string) *bytes.Buffer {
+	req := bytes.NewBuffer([]byte{userAuthVersion, byte(len(user))})
+	req.WriteString(user)
+	req.WriteByte(byte(len(pass)))
+	req.WriteString(pass)
+	return req
+}
+
+func TestWebhookStore(t *testing.T) {
+	srv, calls := newTestWebhook(t)
+	store := NewWebhookStore(WebhookConfig{
+		URL:      srv.URL,
+		Header:   http.Header{"Authorization": {"Bearer token"}},
+		Timeout:  50 * time.Millisecond,
+		CacheTTL: time.Minute,
+	})
+	defer store.Close()
+	a := UserPassAuthenticator{Credentials: store}
+	info := &ConnInfo{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}}
+
+	var resp bytes.Buffer
+	ctx, err := a.AuthenticateConn(context.Background(), info, userPassRequest("alice", "secret"), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{socks5Version, UserPassAuth, userAuthVersion, authSuccess}, resp.Bytes())
+	assert.Equal(t, map[string]string{
+		"Username":  "alice",
+		"groups":    "dev,ops",
+		"bandwidth": "10",
+		"client_ip": "10.1.2.3",
+	}, ctx.Payload)
+
+	// cached
+	_, err = a.AuthenticateConn(context.Background(), info, userPassRequest("alice", "secret"), &bytes.Buffer{})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, calls.Load())
+
+	resp.Reset()
+	_, err = a.Authenticate(userPassRequest("alice", "guess"), &resp)
+	assert.True(t, errors.Is(err, UserAuthFailed))
+	assert.Equal(t, []byte{socks5Version, UserPassAuth, userAuthVersion, authFailure}, resp.Bytes())
+
+	_, err = a.Authenticate(userPassRequest("broken", "secret"), &bytes.Buffer{})
+	assert.EqualError(t, err, "auth webhook: unexpected status 500 Internal Server Error")
+
+	_, err = a.Authenticate(userPassRequest("slow", "secret"), &bytes.Buffer{})
+	assert.ErrorContains(t, err, "context deadline exceeded")
+	assert.False(t, errors.Is(err, UserAuthFailed), "webhook errors aren't failed logins")
+}
+
+func TestAttributeString(t *testing.T) {
+	assert.Equal(t, "a,b", attributeString([]interface{}{"a", "b"}))
+	assert.Equal(t, "1.5", attributeString(1.5))
+	assert.Equal(t, "true", attributeString(true))
+	assert.Equal(t, "a=1,b=x", attributeString(map[string]interface{}{"b": "x", "a": 1.0}))
+}
@@ -0,0 +1,260 @@
+package ldapauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"socks5-server-ng/pkg/go-socks5"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// Config configures a Store
+type Config struct {
+	// URL of the directory, ldap://host:389 or ldaps://host:636
+	URL string
+	// StartTLS upgrades ldap:// connections to TLS
+	StartTLS bool
+	// TLSConfig is used for ldaps:// and StartTLS
+	TLSConfig *tls.Config
+
+	// BindDN and BindPassword are the account searching users.
+	// If empty, searches are anonymous
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is where users (and groups) are searched
+	BaseDN string
+	// UserFilter finds a user, %s being replaced with the escaped username.
+	// Defaults to (uid=%s)
+	UserFilter string
+
+	// GroupAttribute is the attribute of users listing their groups.
+	// Defaults to memberOf
+	GroupAttribute string
+	// GroupFilter, if set, searches groups rather than reading GroupAttribute,
+	// %s being replaced with the escaped user DN, eg. (member=%s)
+	GroupFilter string
+	// RequiredGroups, if set, only allows members of one of these groups
+	RequiredGroups []string
+
+	// Timeout of connecting and of each operation. Defaults to 5s
+	Timeout time.Duration
+	// CacheTTL is how long a successful login is cached. 0 disables the cache
+	CacheTTL time.Duration
+}
+
+// Store is a socks5.CredentialStore authenticating users by binding to an
+// LDAP directory with their password, after searching their DN.
+// The names of the groups of a user are in the "Groups" attribute, separated
+// by commas.
+type Store struct {
+	conf  Config
+	cache *ttlcache.Cache[[sha256.Size]byte, map[string]string]
+}
+
+var _ socks5.CredentialVerifier = &Store{}
+
+// New creates a Store, and starts its cache expiration routine if caching is enabled
+func New(conf Config) *Store {
+	if conf.UserFilter == "" {
+		conf.UserFilter = "(uid=%s)"
+	}
+	if conf.GroupAttribute == "" {
+		conf.GroupAttribute = "memberOf"
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = 5 * time.Second
+	}
+
+	s := &Store{conf: conf}
+	if conf.CacheTTL > 0 {
+		s.cache = ttlcache.New[[sha256.Size]byte, map[string]string](
+			ttlcache.WithTTL[[sha256.Size]byte, map[string]string](conf.CacheTTL),
+			ttlcache.WithDisableTouchOnHit[[sha256.Size]byte, map[string]string](),
+		)
+		go s.cache.Start()
+	}
+	return s
+}
+
+// Close stops the cache expiration routine
+func (s *Store) Close() {
+	if s.cache != nil {
+		s.cache.Stop()
+	}
+}
+
+func (s *Store) Valid(user, password string) bool {
+	_, err := s.Verify(context.Background(), nil, user, password)
+	return err == nil
+}
+
+func (s *Store) Verify(ctx context.Context, info *socks5.ConnInfo, user, password string) (map[string]string, error) {
+	// an empty password would be an unauthenticated bind, which succeeds
+	if user == "" || password == "" {
+		return nil, socks5.UserAuthFailed
+	}
+
+	var key [sha256.Size]byte
+	if s.cache != nil {
+		key = sha256.Sum256([]byte(user + "\x00" + password))
+		if item := s.cache.Get(key); item != nil {
+			return item.Value(), nil
+		}
+	}
+
+	attrs, err := s.verify(user, password)
+	if err != nil {
+		return nil, err
+	}
+	if s.cache != nil {
+		s.cache.Set(key, attrs, ttlcache.DefaultTTL)
+	}
+	return attrs, nil
+}
+
+func (s *Store) verify(user, password string) (map[string]string, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %v", err)
+	}
+	defer conn.Close()
+
+	if s.conf.BindDN != "" {
+		err = conn.Bind(s.conf.BindDN, s.conf.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap: search bind: %v", err)
+	}
+
+	userDN, groups, err := s.searchUser(conn, user)
+	if err != nil {
+		return nil, err
+	}
+	if s.conf.GroupFilter != "" {
+		if groups, err = s.searchGroups(conn, userDN); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := conn.Bind(userDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, socks5.UserAuthFailed
+		}
+		return nil, fmt.Errorf("ldap: bind %s: %v", userDN, err)
+	}
+	if len(s.conf.RequiredGroups) > 0 && !containsAny(groups, s.conf.RequiredGroups) {
+		return nil, socks5.UserAuthFailed
+	}
+
+	return map[string]string{"Groups": strings.Join(groups, ",")}, nil
+}
+
+func (s *Store) dial() (*ldap.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.conf.Timeout}
+	conn, err := ldap.DialURL(s.conf.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(s.conf.TLSConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(s.conf.Timeout)
+
+	if s.conf.StartTLS {
+		tlsConfig := s.conf.TLSConfig
+		if tlsConfig == nil {
+			u, _ := url.Parse(s.conf.URL)
+			tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		}
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+// searchUser returns the DN of a user, and the groups listed in its GroupAttribute
+func (s *Store) searchUser(conn *ldap.Conn, user string) (string, []string, error) {
+	res, err := conn.Search(ldap.NewSearchRequest(
+		s.conf.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(s.conf.UserFilter, ldap.EscapeFilter(user)),
+		[]string{"dn", s.conf.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return "", nil, socks5.UserAuthFailed
+		}
+		return "", nil, fmt.Errorf("ldap: search %s: %v", user, err)
+	}
+	if len(res.Entries) != 1 {
+		return "", nil, socks5.UserAuthFailed
+	}
+
+	entry := res.Entries[0]
+	var groups []string
+	for _, dn := range entry.GetAttributeValues(s.conf.GroupAttribute) {
+		groups = append(groups, groupName(dn))
+	}
+	sort.Strings(groups)
+	return entry.DN, groups, nil
+}
+
+// searchGroups returns the names of the groups matching GroupFilter for a user
+func (s *Store) searchGroups(conn *ldap.Conn, userDN string) ([]string, error) {
+	res, err := conn.Search(ldap.NewSearchRequest(
+		s.conf.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(s.conf.GroupFilter, ldap.EscapeFilter(userDN)),
+		[]string{"cn"},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: search groups of %s: %v", userDN, err)
+	}
+
+	var groups []string
+	for _, entry := range res.Entries {
+		if cn := entry.GetAttributeValue("cn"); cn != "" {
+			groups = append(groups, cn)
+		} else {
+			groups = append(groups, groupName(entry.DN))
+		}
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+// groupName returns the CN of a group DN, or the DN itself
+func groupName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return dn
+	}
+	for _, attr := range parsed.RDNs[0].Attributes {
+		if strings.EqualFold(attr.Type, "cn") {
+			return attr.Value
+		}
+	}
+	return dn
+}
+
+func containsAny(values, wanted []string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
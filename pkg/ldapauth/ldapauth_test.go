@@ -0,0 +1,274 @@
+package ldapauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"socks5-server-ng/pkg/go-socks5"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+type testEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// testDirectory is an in-process LDAP stand-in, supporting simple binds,
+// searches with equality filters, and StartTLS
+type testDirectory struct {
+	entries []testEntry
+	tls     *tls.Config
+	binds   atomic.Int64
+}
+
+func (d *testDirectory) serve(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.handle(conn)
+		}
+	}()
+	return "ldap://" + l.Addr().String()
+}
+
+func (d *testDirectory) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			d.binds.Add(1)
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			if dn == "" && password == "" {
+				code = ldap.LDAPResultSuccess
+			}
+			for _, e := range d.entries {
+				if e.dn == dn && e.password == password {
+					code = ldap.LDAPResultSuccess
+				}
+			}
+			d.reply(conn, id, ldap.ApplicationBindResponse, code)
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for _, e := range d.entries {
+				if e.matches(filter) {
+					d.sendEntry(conn, id, e)
+				}
+			}
+			d.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+		case ldap.ApplicationExtendedRequest:
+			if d.tls == nil {
+				d.reply(conn, id, ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError)
+				continue
+			}
+			d.reply(conn, id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess)
+			conn = tls.Server(conn, d.tls)
+		default:
+			return
+		}
+	}
+}
+
+// matches supports (attr=value) filters
+func (e testEntry) matches(filter string) bool {
+	attr, value, ok := strings.Cut(strings.Trim(filter, "()"), "=")
+	if !ok {
+		return false
+	}
+	for _, v := range e.attrs[attr] {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *testDirectory) reply(conn net.Conn, id int64, tag ber.Tag, code int) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	d.send(conn, id, op)
+}
+
+func (d *testDirectory) sendEntry(conn net.Conn, id int64, e testEntry) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+	attrs := ber.NewSequence("")
+	for name, values := range e.attrs {
+		attr := ber.NewSequence("")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	d.send(conn, id, op)
+}
+
+func (d *testDirectory) send(conn net.Conn, id int64, op *ber.Packet) {
+	packet := ber.NewSequence("")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
+
+func newTestDirectory() *testDirectory {
+	return &testDirectory{
+		entries: []testEntry{
+			{
+				dn:       "uid=alice,ou=people,dc=example,dc=com",
+				password: "secret",
+				attrs: map[string][]string{
+					"uid":      {"alice"},
+					"memberOf": {"cn=ops,ou=groups,dc=example,dc=com", "cn=dev,ou=groups,dc=example,dc=com"},
+				},
+			},
+			{
+				dn:       "uid=bob,ou=people,dc=example,dc=com",
+				password: "hunter2",
+				attrs:    map[string][]string{"uid": {"bob"}},
+			},
+			{
+				dn:    "cn=proxy,ou=groups,dc=example,dc=com",
+				attrs: map[string][]string{"cn": {"proxy"}, "member": {"uid=bob,ou=people,dc=example,dc=com"}},
+			},
+		},
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir := newTestDirectory()
+	store := New(Config{
+		URL:      dir.serve(t),
+		BaseDN:   "dc=example,dc=com",
+		CacheTTL: time.Minute,
+	})
+	defer store.Close()
+
+	attrs, err := store.Verify(context.Background(), nil, "alice", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Groups": "dev,ops"}, attrs)
+
+	// cached
+	binds := dir.binds.Load()
+	assert.True(t, store.Valid("alice", "secret"))
+	assert.Equal(t, binds, dir.binds.Load())
+
+	_, err = store.Verify(context.Background(), nil, "alice", "guess")
+	assert.True(t, errors.Is(err, socks5.UserAuthFailed))
+	_, err = store.Verify(context.Background(), nil, "mallory", "secret")
+	assert.True(t, errors.Is(err, socks5.UserAuthFailed))
+	assert.False(t, store.Valid("alice", ""), "empty passwords are unauthenticated binds")
+}
+
+func TestStoreGroups(t *testing.T) {
+	store := New(Config{
+		URL:            newTestDirectory().serve(t),
+		BaseDN:         "dc=example,dc=com",
+		GroupFilter:    "(member=%s)",
+		RequiredGroups: []string{"proxy"},
+	})
+
+	attrs, err := store.Verify(context.Background(), nil, "bob", "hunter2")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Groups": "proxy"}, attrs)
+
+	_, err = store.Verify(context.Background(), nil, "alice", "secret")
+	assert.True(t, errors.Is(err, socks5.UserAuthFailed), "alice isn't in the proxy group")
+}
+
+func TestStoreStartTLS(t *testing.T) {
+	dir := newTestDirectory()
+	cert, pool := testCertificate(t)
+	dir.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	store := New(Config{
+		URL:       dir.serve(t),
+		StartTLS:  true,
+		TLSConfig: &tls.Config{RootCAs: pool, ServerName: "localhost"},
+		BaseDN:    "dc=example,dc=com",
+	})
+	assert.True(t, store.Valid("alice", "secret"))
+
+	store = New(Config{
+		URL:       dir.serve(t),
+		StartTLS:  true,
+		TLSConfig: &tls.Config{ServerName: "localhost"},
+		BaseDN:    "dc=example,dc=com",
+	})
+	_, err := store.Verify(context.Background(), nil, "alice", "secret")
+	assert.ErrorContains(t, err, "StartTLS")
+	assert.False(t, errors.Is(err, socks5.UserAuthFailed), "directory errors aren't failed logins")
+}
+
+func TestStoreUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	l.Close()
+
+	store := New(Config{URL: "ldap://" + l.Addr().String(), Timeout: time.Second})
+	_, err = store.Verify(context.Background(), nil, "alice", "secret")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, socks5.UserAuthFailed))
+}
+
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	parsed, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
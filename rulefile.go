@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"socks5-server-ng/pkg/go-socks5"
+)
+
+// A rule file contains one rule per line, evaluated in order until one matches:
+//
+//	# comment
+//	allow user=alice dest=*.example.com port=443 cmd=connect
+//	deny dest-cidr=10.0.0.0/8,192.168.0.0/16
+//	deny
+//
+// A rule matches when all its conditions match; a condition matches when any of
+// its comma-separated values match. A rule without conditions matches everything.
+//
+// When domains are sniffed from connections to IPs, the domain can be forged
+// by the client: a rule allowing a connection by its domain is then overruled
+// by any later deny rule on the destination address or port (a dest-cidr or
+// port condition, or a dest pattern matching the IP).
+//
+// Conditions:
+//
+//	user=NAME        authenticated username
+//	group=NAME       group of the authenticated user, from LDAP or the webhook
+//	dest=PATTERN     destination domain (or IP), with * wildcards
+//	dest-cidr=CIDR   resolved destination IP
+//	src-cidr=CIDR    client IP
+//	port=PORTS       destination ports and ranges, eg. 80,443,8000-8100
+//	cmd=COMMAND      connect, bind, associate, or udp for the targets of
+//	                 datagrams within an association
+//
+// Schedule conditions, see Schedule:
+//
+//	time=RANGES      time ranges, eg. 09:00-12:00,13:00-17:00 or 22:00-06:00
+//	days=DAYS        days of week the time ranges start, eg. mon-fri,sun
+//	date=DATES       dates the time ranges start, eg. 2026-12-24,2026-12-30..2027-01-01
+//	tz=ZONE          timezone of the schedule, eg. Europe/Berlin. Defaults to local
+//	cut=true         close sessions allowed by the rule when the window ends
+//
+// Options of allow rules:
+//
+//	proxy-protocol=v1|v2  send a PROXY protocol header to CONNECT targets,
+//	                      carrying the client address, and with v2 the
+//	                      requested domain and the username
+type ruleCondition func(req *socks5.Request) bool
+
+var ruleConditions = map[string]func(values []string) (ruleCondition, error){
+	"user": func(values []string) (ruleCondition, error) {
+		return func(req *socks5.Request) bool {
+			if req.AuthContext == nil {
+				return false
+			}
+			return containsString(values, req.AuthContext.Payload["Username"])
+		}, nil
+	},
+	"group": func(values []string) (ruleCondition, error) {
+		return func(req *socks5.Request) bool {
+			if req.AuthContext == nil || req.AuthContext.Payload["Groups"] == "" {
+				return false
+			}
+			for _, group := range strings.Split(req.AuthContext.Payload["Groups"], ",") {
+				if containsString(values, group) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	},
+	"dest": func(values []string) (ruleCondition, error) {
+		for i, pattern := range values {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q", pattern)
+			}
+			values[i] = strings.ToLower(pattern)
+		}
+		return func(req *socks5.Request) bool {
+			dest := strings.ToLower(req.DestAddr.FqdnOrIP())
+			for _, pattern := range values {
+				if ok, _ := path.Match(pattern, dest); ok {
+					return true
+				}
+			}
+			return false
+		}, nil
+	},
+	"dest-cidr": func(values []string) (ruleCondition, error) {
+		cidrs, err := socks5.NewCidrSet(values...)
+		if err != nil {
+			return nil, err
+		}
+		return func(req *socks5.Request) bool {
+			return req.DestAddr.IP != nil && cidrs.Allowed(req.DestAddr.IP)
+		}, nil
+	},
+	"src-cidr": func(values []string) (ruleCondition, error) {
+		cidrs, err := socks5.NewCidrSet(values...)
+		if err != nil {
+			return nil, err
+		}
+		return func(req *socks5.Request) bool {
+			return req.RemoteAddr != nil && cidrs.Allowed(req.RemoteAddr.IP)
+		}, nil
+	},
+	"port": func(values []string) (ruleCondition, error) {
+		ports, err := ParsePortList(strings.Join(values, ","))
+		if err != nil {
+			return nil, err
+		}
+		return func(req *socks5.Request) bool {
+			return ports.Contains(req.DestAddr.Port)
+		}, nil
+	},
+	"cmd": func(values []string) (ruleCondition, error) {
+		for i, name := range values {
+			values[i] = strings.ToLower(name)
+			if _, ok := commandNames[values[i]]; !ok {
+				return nil, fmt.Errorf("unknown command %q", name)
+			}
+		}
+		return func(req *socks5.Request) bool {
+			return containsString(values, commandName(req))
+		}, nil
+	},
+}
+
+var commandNames = map[string]uint8{
+	"connect":     socks5.ConnectCommand,
+	"bind":        socks5.BindCommand,
+	"associate":   socks5.AssociateCommand,
+	"udp":         socks5.AssociateCommand,
+	"resolve":     socks5.ResolveCommand,
+	"resolve-ptr": socks5.ResolvePTRCommand,
+}
+
+// commandName returns the name of the request's command, as in rule files
+func commandName(req *socks5.Request) string {
+	switch req.Command {
+	case socks5.ConnectCommand:
+		return "connect"
+	case socks5.BindCommand:
+		return "bind"
+	case socks5.AssociateCommand:
+		if req.Datagram {
+			return "udp"
+		}
+		return "associate"
+	case socks5.ResolveCommand:
+		return "resolve"
+	case socks5.ResolvePTRCommand:
+		return "resolve-ptr"
+	}
+	return fmt.Sprintf("%d", req.Command)
+}
+
+// FileRule is a rule parsed from a rule file
+type FileRule struct {
+	Name       string // file:line
+	Text       string
+	Verdict    socks5.Verdict
+	conditions []ruleCondition
+	// dest matches the destination. Allow rules depending on a sniffed
+	// domain are pending, see socks5.Request.Sniffing
+	dest ruleCondition
+	// byAddress is true for rules with conditions on the destination
+	// address or port
+	byAddress bool
+	schedule  *Schedule
+	cut       bool
+	// proxyHeader is the PROXY protocol version sent to targets, if any
+	proxyHeader uint8
+}
+
+func (s *FileRule) Evaluate(ctx context.Context, req *socks5.Request) socks5.Decision {
+	return s.EvaluateAt(req, time.Now())
+}
+
+// EvaluateAt evaluates the request as if it was received at the given time
+func (s *FileRule) EvaluateAt(req *socks5.Request, now time.Time) socks5.Decision {
+	for _, cond := range s.conditions {
+		if !cond(req) {
+			return socks5.Decision{}
+		}
+	}
+	pending, byAddress := false, s.byAddress
+	if s.dest != nil {
+		match := s.dest(req)
+		if !match && !(req.Sniffing && s.Verdict == socks5.VerdictAllow) {
+			return socks5.Decision{}
+		}
+		// allowed by a domain yet to sniff, or by the sniffed one
+		pending = req.Sniffing && !match || req.Sniffed && match
+		byAddress = byAddress || match && req.DestAddr.FQDN == ""
+	}
+	d := socks5.Decision{
+		Verdict: s.Verdict,
+		Rule:    s.Name,
+		Reason:  s.Text,
+	}
+	if s.Verdict == socks5.VerdictAllow {
+		d.Pending = pending
+		if req.Command == socks5.ConnectCommand {
+			d.ProxyHeader = s.proxyHeader
+		}
+	} else {
+		d.ByAddress = byAddress
+	}
+	if s.schedule != nil {
+		if !s.schedule.Contains(now) {
+			return socks5.Decision{}
+		}
+		if s.cut && s.Verdict == socks5.VerdictAllow {
+			d.Until = s.schedule.End(now)
+		}
+	}
+	return d
+}
+
+// LoadRuleFile parses a rule file
+func LoadRuleFile(filename string) ([]*FileRule, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRules(filename, f)
+}
+
+// ParseRules parses rules; errors point at name:line
+func ParseRules(name string, r io.Reader) ([]*FileRule, error) {
+	var rules []*FileRule
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		rule, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, lineNum, err)
+		}
+		rule.Name = fmt.Sprintf("%s:%d", name, lineNum)
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return rules, nil
+}
+
+func parseRule(line string) (*FileRule, error) {
+	fields := strings.Fields(line)
+	rule := &FileRule{Text: line}
+
+	switch fields[0] {
+	case "allow":
+		rule.Verdict = socks5.VerdictAllow
+	case "deny":
+		rule.Verdict = socks5.VerdictDeny
+	default:
+		return nil, fmt.Errorf("expected allow or deny, got %q", fields[0])
+	}
+
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", field)
+		}
+		values := strings.Split(value, ",")
+
+		if isScheduleKey(key) {
+			if rule.schedule == nil {
+				rule.schedule = &Schedule{}
+			}
+			if err := rule.parseSchedule(key, values); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			continue
+		}
+		if key == "proxy-protocol" {
+			version, err := parseProxyProtocol(rule.Verdict, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			rule.proxyHeader = version
+			continue
+		}
+
+		newCondition, ok := ruleConditions[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown condition %q", key)
+		}
+		cond, err := newCondition(values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		if key == "dest" {
+			if prev := rule.dest; prev != nil {
+				next := cond
+				cond = func(req *socks5.Request) bool { return prev(req) && next(req) }
+			}
+			rule.dest = cond
+			continue
+		}
+		rule.conditions = append(rule.conditions, cond)
+		if key == "dest-cidr" || key == "port" {
+			rule.byAddress = true
+		}
+	}
+
+	return rule, nil
+}
+
+func parseProxyProtocol(verdict socks5.Verdict, value string) (uint8, error) {
+	if verdict != socks5.VerdictAllow {
+		return 0, fmt.Errorf("only for allow rules")
+	}
+	switch value {
+	case "v1":
+		return 1, nil
+	case "v2":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("expected v1 or v2, got %q", value)
+}
+
+func isScheduleKey(key string) bool {
+	switch key {
+	case "time", "days", "date", "tz", "cut":
+		return true
+	}
+	return false
+}
+
+func (s *FileRule) parseSchedule(key string, values []string) (err error) {
+	switch key {
+	case "time":
+		return s.schedule.ParseTimeRanges(values)
+	case "days":
+		return s.schedule.ParseDays(values)
+	case "date":
+		return s.schedule.ParseDates(values)
+	case "tz":
+		s.schedule.Location, err = time.LoadLocation(values[0])
+		return err
+	case "cut":
+		s.cut, err = strconv.ParseBool(values[0])
+		return err
+	}
+	return nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRulesCommand evaluates a hypothetical request against a rule file,
+// and prints the matching rule. Exits with 1 if the request is denied.
+func checkRulesCommand(args []string) int {
+	flags := flag.NewFlagSet("check-rules", flag.ExitOnError)
+	file := flags.String("file", os.Getenv("PROXY_RULES_FILE"), "rule file")
+	user := flags.String("user", "", "authenticated username")
+	groups := flags.String("groups", "", "groups of the user, separated by commas")
+	dest := flags.String("dest", "", "destination domain or IP")
+	destIP := flags.String("dest-ip", "", "resolved destination IP, if dest is a domain")
+	port := flags.Int("port", 443, "destination port")
+	cmd := flags.String("cmd", "connect", "command: connect, bind, associate, udp, resolve or resolve-ptr")
+	src := flags.String("src", "127.0.0.1", "client IP")
+	at := flags.String("at", "", "evaluate at this time (RFC3339) rather than now")
+	flags.Parse(args)
+
+	now := time.Now()
+	if *at != "" {
+		var err error
+		if now, err = time.Parse(time.RFC3339, *at); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	rules, err := LoadRuleFile(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	command, ok := commandNames[*cmd]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", *cmd)
+		return 2
+	}
+
+	req := &socks5.Request{
+		Version:    5,
+		Command:    command,
+		Datagram:   *cmd == "udp",
+		RemoteAddr: &socks5.AddrSpec{IP: net.ParseIP(*src)},
+		DestAddr:   &socks5.AddrSpec{Port: *port},
+	}
+	if ip := net.ParseIP(*dest); ip != nil {
+		req.DestAddr.IP = ip
+	} else {
+		req.DestAddr.FQDN = *dest
+		req.DestAddr.IP = net.ParseIP(*destIP)
+	}
+	if *user != "" {
+		req.AuthContext = &socks5.AuthContext{
+			Method:  socks5.UserPassAuth,
+			Payload: map[string]string{"Username": *user, "Groups": *groups},
+		}
+	}
+
+	for _, rule := range rules {
+		if d := rule.EvaluateAt(req, now); d.Verdict != socks5.VerdictAbstain {
+			fmt.Printf("%s: %s\n", d.Rule, d.Reason)
+			if !d.Until.IsZero() {
+				fmt.Printf("sessions closed at %s\n", d.Until.Format(time.RFC3339))
+			}
+			if d.ProxyHeader != 0 {
+				fmt.Printf("PROXY protocol v%d header sent to the target\n", d.ProxyHeader)
+			}
+			if d.Verdict == socks5.VerdictDeny {
+				return 1
+			}
+			return 0
+		}
+	}
+
+	fmt.Println("no rule matched, the default applies")
+	return 0
+}
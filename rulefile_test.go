@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"socks5-server-ng/pkg/go-socks5"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("test.rules", strings.NewReader(`
+# comment
+allow user=alice dest=*.example.com port=443 cmd=connect
+deny dest-cidr=10.0.0.0/8 # trailing
+allow cmd=associate
+allow cmd=udp port=53
+deny
+`))
+	assert.NoError(t, err)
+	assert.Len(t, rules, 5)
+
+	match := func(req *socks5.Request) string {
+		for _, rule := range rules {
+			if d := rule.Evaluate(context.Background(), req); d.Verdict != socks5.VerdictAbstain {
+				return d.Rule
+			}
+		}
+		return ""
+	}
+	alice := &socks5.AuthContext{Payload: map[string]string{"Username": "alice"}}
+
+	assert.Equal(t, "test.rules:3", match(&socks5.Request{Command: socks5.ConnectCommand, AuthContext: alice, DestAddr: &socks5.AddrSpec{FQDN: "www.example.com", Port: 443}}))
+	assert.Equal(t, "test.rules:7", match(&socks5.Request{Command: socks5.ConnectCommand, DestAddr: &socks5.AddrSpec{FQDN: "www.example.com", Port: 443}}))
+	assert.Equal(t, "test.rules:4", match(&socks5.Request{Command: socks5.ConnectCommand, DestAddr: &socks5.AddrSpec{IP: net.ParseIP("10.1.2.3"), Port: 80}}))
+	assert.Equal(t, "test.rules:5", match(&socks5.Request{Command: socks5.AssociateCommand, DestAddr: &socks5.AddrSpec{IP: net.IPv4zero}}))
+	assert.Equal(t, "test.rules:6", match(&socks5.Request{Command: socks5.AssociateCommand, Datagram: true, DestAddr: &socks5.AddrSpec{IP: net.ParseIP("1.1.1.1"), Port: 53}}))
+	assert.Equal(t, "test.rules:7", match(&socks5.Request{Command: socks5.AssociateCommand, Datagram: true, DestAddr: &socks5.AddrSpec{IP: net.ParseIP("1.1.1.1"), Port: 80}}))
+}
+
+func TestRuleResolve(t *testing.T) {
+	rules, err := ParseRules("test.rules", strings.NewReader(`
+deny cmd=resolve dest=*.internal
+allow cmd=resolve,resolve-ptr
+`))
+	assert.NoError(t, err)
+
+	resolve := &socks5.Request{Command: socks5.ResolveCommand, DestAddr: &socks5.AddrSpec{FQDN: "db.internal"}}
+	assert.Equal(t, socks5.VerdictDeny, rules[0].Evaluate(context.Background(), resolve).Verdict)
+	resolve.DestAddr.FQDN = "example.com"
+	assert.Equal(t, socks5.VerdictAbstain, rules[0].Evaluate(context.Background(), resolve).Verdict)
+	assert.Equal(t, socks5.VerdictAllow, rules[1].Evaluate(context.Background(), resolve).Verdict)
+
+	ptr := &socks5.Request{Command: socks5.ResolvePTRCommand, DestAddr: &socks5.AddrSpec{IP: net.ParseIP("1.1.1.1")}}
+	assert.Equal(t, socks5.VerdictAllow, rules[1].Evaluate(context.Background(), ptr).Verdict)
+
+	// lookups have no port, nor a host name for PTR
+	ports, err := newPortRule("443", false)
+	assert.NoError(t, err)
+	assert.True(t, ports.Allow(context.Background(), resolve))
+	assert.True(t, RuleRequireFQDN().Allow(context.Background(), ptr))
+}
+
+func TestRuleGroup(t *testing.T) {
+	rules, err := ParseRules("test.rules", strings.NewReader("allow group=ops,admins"))
+	assert.NoError(t, err)
+
+	req := &socks5.Request{
+		Command:     socks5.ConnectCommand,
+		AuthContext: &socks5.AuthContext{Payload: map[string]string{"Username": "alice", "Groups": "dev,ops"}},
+		DestAddr:    &socks5.AddrSpec{FQDN: "example.com", Port: 443},
+	}
+	assert.Equal(t, socks5.VerdictAllow, rules[0].Evaluate(context.Background(), req).Verdict)
+
+	req.AuthContext.Payload["Groups"] = "dev"
+	assert.Equal(t, socks5.VerdictAbstain, rules[0].Evaluate(context.Background(), req).Verdict)
+}
+
+func TestRuleSniffing(t *testing.T) {
+	rules, err := ParseRules("test.rules", strings.NewReader(`
+deny dest=*.internal
+deny dest=10.*
+allow dest=*.example.com
+deny
+`))
+	assert.NoError(t, err)
+	match := func(req *socks5.Request) string {
+		for _, rule := range rules {
+			if d := rule.Evaluate(context.Background(), req); d.Verdict != socks5.VerdictAbstain {
+				return d.Rule
+			}
+		}
+		return ""
+	}
+
+	// before its domain is sniffed, an IP is denied only by rules which
+	// can't match a domain
+	req := &socks5.Request{Command: socks5.ConnectCommand, Sniffing: true, DestAddr: &socks5.AddrSpec{IP: net.ParseIP("192.0.2.1"), Port: 443}}
+	assert.Equal(t, "test.rules:4", match(req))
+	req.DestAddr.IP = net.ParseIP("10.0.0.1")
+	assert.Equal(t, "test.rules:3", match(req))
+
+	req.Sniffing = false
+	req.DestAddr.FQDN = "db.internal"
+	assert.Equal(t, "test.rules:2", match(req))
+	req.DestAddr.FQDN = ""
+	assert.Equal(t, "test.rules:3", match(req))
+
+	pattern, err := PermitDestAddrPattern(`\.example\.com$`)
+	assert.NoError(t, err)
+	req.Sniffing = true
+	assert.True(t, pattern.Allow(context.Background(), req))
+	assert.True(t, RuleRequireFQDN().Allow(context.Background(), req))
+	req.Sniffing = false
+	assert.False(t, pattern.Allow(context.Background(), req))
+	assert.False(t, RuleRequireFQDN().Allow(context.Background(), req))
+}
+
+func TestRuleSniffingForgedDomain(t *testing.T) {
+	fileRules, err := ParseRules("test.rules", strings.NewReader(`
+allow dest=*.example.com
+deny dest-cidr=127.0.0.0/8
+deny
+`))
+	assert.NoError(t, err)
+	rules := &socks5.FirstMatch{Default: socks5.VerdictDeny}
+	for _, rule := range fileRules {
+		rules.Rules = append(rules.Rules, rule)
+	}
+	decide := func(ip, sniffed string) socks5.Decision {
+		req := &socks5.Request{Command: socks5.ConnectCommand, DestAddr: &socks5.AddrSpec{IP: net.ParseIP(ip), Port: 443}}
+		req.Sniffing = sniffed == ""
+		req.Sniffed = sniffed != ""
+		req.DestAddr.FQDN = sniffed
+		return rules.Evaluate(context.Background(), req)
+	}
+
+	// the allowance of a domain yet to sniff is overruled by the denial of
+	// the address, not by the catch-all
+	assert.Equal(t, "test.rules:3", decide("127.0.0.5", "").Rule)
+	assert.Equal(t, "test.rules:2", decide("192.0.2.1", "").Rule)
+	assert.Equal(t, socks5.VerdictAllow, decide("192.0.2.1", "").Verdict)
+	// and so is the allowance of a sniffed domain
+	assert.Equal(t, "test.rules:3", decide("127.0.0.5", "x.example.com").Rule)
+	assert.Equal(t, "test.rules:2", decide("192.0.2.1", "x.example.com").Rule)
+	assert.Equal(t, "test.rules:4", decide("192.0.2.1", "x.example.org").Rule)
+
+	// a target in the denied range isn't connected, whatever the SNI
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer target.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		if conn, err := target.Accept(); err == nil {
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+	server, err := socks5.New(&socks5.Config{Rules: rules, SniffDomains: true, SniffTimeout: 100 * time.Millisecond})
+	assert.NoError(t, err)
+	defer server.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go server.Serve(l)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := (&socks5.Dialer{ProxyAddress: l.Addr().String()}).DialContext(ctx, "tcp", target.Addr().String())
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		tls.Client(conn, &tls.Config{ServerName: "x.example.com"}).Handshake()
+		conn.Close()
+	}
+	assert.ErrorIs(t, err, socks5.ReplyError(socks5.ReplyNotAllowed))
+	select {
+	case <-accepted:
+		t.Error("denied target was connected")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	_, err := ParseRules("test.rules", strings.NewReader("allow\npermit user=bob\n"))
+	assert.EqualError(t, err, `test.rules:2: expected allow or deny, got "permit"`)
+
+	_, err = ParseRules("test.rules", strings.NewReader("deny port=abc"))
+	assert.EqualError(t, err, `test.rules:1: port: invalid port: abc`)
+
+	_, err = ParseRules("test.rules", strings.NewReader("deny color=red"))
+	assert.EqualError(t, err, `test.rules:1: unknown condition "color"`)
+
+	_, err = ParseRules("test.rules", strings.NewReader("deny proxy-protocol=v2"))
+	assert.EqualError(t, err, `test.rules:1: proxy-protocol: only for allow rules`)
+
+	_, err = ParseRules("test.rules", strings.NewReader("allow proxy-protocol=v3"))
+	assert.EqualError(t, err, `test.rules:1: proxy-protocol: expected v1 or v2, got "v3"`)
+}
+
+func TestRuleProxyProtocol(t *testing.T) {
+	rules, err := ParseRules("test.rules", strings.NewReader("allow dest=backend.internal proxy-protocol=v2"))
+	assert.NoError(t, err)
+
+	req := &socks5.Request{
+		Command:  socks5.ConnectCommand,
+		DestAddr: &socks5.AddrSpec{FQDN: "backend.internal", Port: 443},
+	}
+	d := rules[0].Evaluate(context.Background(), req)
+	assert.Equal(t, socks5.VerdictAllow, d.Verdict)
+	assert.EqualValues(t, 2, d.ProxyHeader)
+
+	req.Command = socks5.AssociateCommand
+	assert.EqualValues(t, 0, rules[0].Evaluate(context.Background(), req).ProxyHeader, "only CONNECT streams get headers")
+}
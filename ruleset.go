@@ -2,9 +2,17 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"socks5-server-ng/pkg/domainlist"
+	"socks5-server-ng/pkg/filewatch"
 	"socks5-server-ng/pkg/go-socks5"
+
+	"github.com/sirupsen/logrus"
 )
 
 // PermitDestAddrPattern returns a RuleSet which selectively allows addresses
@@ -23,7 +31,17 @@ type PermitDestAddrPatternRuleSet struct {
 }
 
 func (p *PermitDestAddrPatternRuleSet) Allow(ctx context.Context, req *socks5.Request) bool {
-	return p.re.MatchString(req.DestAddr.FQDN)
+	return req.Sniffing || p.re.MatchString(req.DestAddr.FQDN)
+}
+
+func (p *PermitDestAddrPatternRuleSet) Evaluate(ctx context.Context, req *socks5.Request) socks5.Decision {
+	if !p.Allow(ctx, req) {
+		return socks5.Decision{
+			Verdict: socks5.VerdictDeny,
+			Reason:  fmt.Sprintf("destination %q doesn't match %s", req.DestAddr.FQDN, p.re),
+		}
+	}
+	return socks5.Decision{}
 }
 
 // Special rules
@@ -33,8 +51,181 @@ func (s RequestRule) Allow(ctx context.Context, req *socks5.Request) bool {
 	return s(req)
 }
 
+// RuleRequireFQDN denies requests to IPs, except for the host name of an IP
 func RuleRequireFQDN() RequestRule {
 	return func(req *socks5.Request) bool {
-		return req.DestAddr.FQDN != ""
+		return req.DestAddr.FQDN != "" || req.Sniffing || req.Command == socks5.ResolvePTRCommand
+	}
+}
+
+// DomainListRuleSet is an implementation of the RuleSet which denies
+// destinations found in any deny list, and when allow lists are given,
+// only allows destinations found in one of them
+type DomainListRuleSet struct {
+	AllowLists []*domainlist.List
+	DenyLists  []*domainlist.List
+}
+
+func (p *DomainListRuleSet) Allow(ctx context.Context, req *socks5.Request) bool {
+	return p.Evaluate(ctx, req).Verdict != socks5.VerdictDeny
+}
+
+func (p *DomainListRuleSet) Evaluate(ctx context.Context, req *socks5.Request) socks5.Decision {
+	fqdn := req.DestAddr.FQDN
+	for _, list := range p.DenyLists {
+		if list.Match(fqdn) {
+			return socks5.Decision{
+				Verdict: socks5.VerdictDeny,
+				Reason:  fmt.Sprintf("%q is in deny list %s", fqdn, list.Path()),
+			}
+		}
+	}
+	// the domain of the IP is still to be sniffed
+	if len(p.AllowLists) == 0 || req.Sniffing {
+		return socks5.Decision{}
+	}
+	for _, list := range p.AllowLists {
+		if list.Match(fqdn) {
+			return socks5.Decision{}
+		}
+	}
+	return socks5.Decision{
+		Verdict: socks5.VerdictDeny,
+		Reason:  fmt.Sprintf("%q is in no allow list", fqdn),
+	}
+}
+
+// openDomainLists opens each domain list, and reloads it when its file changes
+func openDomainLists(paths []string, pollInterval time.Duration) ([]*domainlist.List, error) {
+	var lists []*domainlist.List
+	for _, path := range paths {
+		list, err := domainlist.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Infof("Loaded %d domains from %s", list.Len(), path)
+
+		filewatch.Watch(path, pollInterval, func() {
+			if err := list.Reload(); err != nil {
+				logrus.Warnf("Failed to reload domain list %s: %v", list.Path(), err)
+				return
+			}
+			logrus.Infof("Reloaded %d domains from %s", list.Len(), list.Path())
+		})
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
+
+// PortList is a set of ports and port ranges, eg. "22,80,443,8000-8100"
+type PortList []PortRange
+
+type PortRange struct {
+	From, To int
+}
+
+func ParsePortList(spec string) (PortList, error) {
+	var ret PortList
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		from, to, isRange := strings.Cut(part, "-")
+		if !isRange {
+			to = from
+		}
+		fromPort, err := parsePort(from)
+		if err != nil {
+			return nil, err
+		}
+		toPort, err := parsePort(to)
+		if err != nil {
+			return nil, err
+		}
+		if toPort < fromPort {
+			return nil, fmt.Errorf("invalid port range: %s", part)
+		}
+		ret = append(ret, PortRange{fromPort, toPort})
+	}
+	return ret, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port: %s", s)
+	}
+	return port, nil
+}
+
+func (s PortList) Contains(port int) bool {
+	for _, r := range s {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+// DestPortRuleSet is an implementation of the RuleSet which allows (or
+// with Deny, denies) destination ports in Ports. If Commands is set, other
+// commands aren't restricted.
+// UDP associate requests are checked for each datagram target, as the
+// address in the associate request itself is the client's, and lookups
+// have no port.
+type DestPortRuleSet struct {
+	Ports    PortList
+	Commands []uint8
+	Deny     bool
+}
+
+func (p *DestPortRuleSet) Allow(ctx context.Context, req *socks5.Request) bool {
+	if len(p.Commands) > 0 && !containsCommand(p.Commands, req.Command) {
+		return true
+	}
+	if req.Command == socks5.AssociateCommand && !req.Datagram {
+		return true
+	}
+	if req.Command == socks5.ResolveCommand || req.Command == socks5.ResolvePTRCommand {
+		return true
+	}
+	return p.Ports.Contains(req.DestAddr.Port) != p.Deny
+}
+
+func (p *DestPortRuleSet) Evaluate(ctx context.Context, req *socks5.Request) socks5.Decision {
+	if p.Allow(ctx, req) {
+		return socks5.Decision{}
+	}
+	reason := "not allowed"
+	if p.Deny {
+		reason = "denied"
+	}
+	return socks5.Decision{
+		Verdict: socks5.VerdictDeny,
+		Reason:  fmt.Sprintf("port %d is %s", req.DestAddr.Port, reason),
+	}
+}
+
+func containsCommand(commands []uint8, cmd uint8) bool {
+	for _, c := range commands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// newPortRule parses a port list into a DestPortRuleSet, for commands (or all if none)
+func newPortRule(spec string, deny bool, commands ...uint8) (*DestPortRuleSet, error) {
+	ports, err := ParsePortList(spec)
+	if err != nil {
+		return nil, err
 	}
+	return &DestPortRuleSet{
+		Ports:    ports,
+		Commands: commands,
+		Deny:     deny,
+	}, nil
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"socks5-server-ng/pkg/go-socks5"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortList(t *testing.T) {
+	tests := []struct {
+		spec string
+		want PortList
+		err  bool
+	}{
+		{"", nil, false},
+		{"443", PortList{{443, 443}}, false},
+		{" 22, 80 ,8000-8100", PortList{{22, 22}, {80, 80}, {8000, 8100}}, false},
+		{"0,65535", PortList{{0, 0}, {65535, 65535}}, false},
+		{"1,,2", PortList{{1, 1}, {2, 2}}, false},
+		{"http", nil, true},
+		{"65536", nil, true},
+		{"-1", nil, true},
+		{"100-90", nil, true},
+		{"80-", nil, true},
+		{"1-2-3", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			ports, err := ParsePortList(tt.spec)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, ports)
+		})
+	}
+
+	ports, _ := ParsePortList("22,8000-8100")
+	assert.True(t, ports.Contains(22))
+	assert.True(t, ports.Contains(8000))
+	assert.True(t, ports.Contains(8100))
+	assert.False(t, ports.Contains(8101))
+	assert.False(t, ports.Contains(80))
+}
+
+func TestDestPortRuleSet(t *testing.T) {
+	allowed, err := newPortRule("443,8000-8100", false)
+	assert.NoError(t, err)
+	denied, err := newPortRule("22", true)
+	assert.NoError(t, err)
+	connectOnly, err := newPortRule("443", false, socks5.ConnectCommand)
+	assert.NoError(t, err)
+	udpOnly, err := newPortRule("53", false, socks5.AssociateCommand)
+	assert.NoError(t, err)
+	_, err = newPortRule("22,ssh", true)
+	assert.Error(t, err)
+
+	request := func(cmd uint8, datagram bool, port int) *socks5.Request {
+		return &socks5.Request{Command: cmd, Datagram: datagram, DestAddr: &socks5.AddrSpec{FQDN: "example.com", Port: port}}
+	}
+	tests := []struct {
+		name  string
+		rule  *DestPortRuleSet
+		req   *socks5.Request
+		allow bool
+	}{
+		{"allowed port", allowed, request(socks5.ConnectCommand, false, 443), true},
+		{"allowed range", allowed, request(socks5.ConnectCommand, false, 8050), true},
+		{"other port", allowed, request(socks5.ConnectCommand, false, 80), false},
+		{"denied port", denied, request(socks5.ConnectCommand, false, 22), false},
+		{"not denied port", denied, request(socks5.ConnectCommand, false, 80), true},
+		{"associate request", allowed, request(socks5.AssociateCommand, false, 50000), true},
+		{"datagram target", allowed, request(socks5.AssociateCommand, true, 53), false},
+		{"denied datagram target", denied, request(socks5.AssociateCommand, true, 22), false},
+		{"resolve", allowed, request(socks5.ResolveCommand, false, 0), true},
+		{"resolve-ptr", allowed, request(socks5.ResolvePTRCommand, false, 0), true},
+		{"connect only", connectOnly, request(socks5.ConnectCommand, false, 80), false},
+		{"connect only datagram", connectOnly, request(socks5.AssociateCommand, true, 80), true},
+		{"udp only datagram", udpOnly, request(socks5.AssociateCommand, true, 53), true},
+		{"udp only other datagram", udpOnly, request(socks5.AssociateCommand, true, 123), false},
+		{"udp only connect", udpOnly, request(socks5.ConnectCommand, false, 443), true},
+		{"udp only bind", udpOnly, request(socks5.BindCommand, false, 443), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := tt.rule.Evaluate(context.Background(), tt.req)
+			assert.Equal(t, tt.allow, tt.rule.Allow(context.Background(), tt.req))
+			if tt.allow {
+				assert.Equal(t, socks5.VerdictAbstain, d.Verdict)
+			} else {
+				assert.Equal(t, socks5.VerdictDeny, d.Verdict)
+				assert.Contains(t, d.Reason, "port")
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // the container image has no zoneinfo
+)
+
+// Schedule is a set of time windows, in a timezone.
+// A moment is in the schedule when it matches the time ranges (if any), the
+// days of week (if any) and the dates (if any). Days and dates apply to the
+// local date a time range starts, so an overnight time range 22:00-06:00 on
+// "fri" matches from friday 22:00 to saturday 06:00.
+type Schedule struct {
+	Location *time.Location
+	times    []clockRange
+	days     []time.Weekday
+	dates    []dateRange
+}
+
+// clockRange is [from, to) in seconds since midnight; overnight when from > to
+type clockRange struct {
+	from, to int
+}
+
+// dateRange is an inclusive range of local dates, as yyyymmdd
+type dateRange struct {
+	from, to int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseTimeRanges parses ranges like "09:00-12:00,13:00-17:30"
+func (s *Schedule) ParseTimeRanges(values []string) error {
+	for _, value := range values {
+		from, to, ok := strings.Cut(value, "-")
+		if !ok {
+			return fmt.Errorf("invalid time range %q", value)
+		}
+		fromSec, err := parseClock(from)
+		if err != nil {
+			return err
+		}
+		toSec, err := parseClock(to)
+		if err != nil {
+			return err
+		}
+		s.times = append(s.times, clockRange{fromSec, toSec})
+	}
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		if s != "24:00" {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		return 24 * 3600, nil
+	}
+	return t.Hour()*3600 + t.Minute()*60, nil
+}
+
+// ParseDays parses days of week and ranges, like "mon-fri,sun"
+func (s *Schedule) ParseDays(values []string) error {
+	for _, value := range values {
+		from, to, isRange := strings.Cut(strings.ToLower(value), "-")
+		if !isRange {
+			to = from
+		}
+		fromDay, ok := weekdays[from]
+		if !ok {
+			return fmt.Errorf("invalid day %q", from)
+		}
+		toDay, ok := weekdays[to]
+		if !ok {
+			return fmt.Errorf("invalid day %q", to)
+		}
+		for d := fromDay; ; d = (d + 1) % 7 {
+			s.days = append(s.days, d)
+			if d == toDay {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// ParseDates parses dates and ranges, like "2026-12-24,2026-12-30..2027-01-01"
+func (s *Schedule) ParseDates(values []string) error {
+	for _, value := range values {
+		from, to, isRange := strings.Cut(value, "..")
+		if !isRange {
+			to = from
+		}
+		fromDate, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return fmt.Errorf("invalid date %q", from)
+		}
+		toDate, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return fmt.Errorf("invalid date %q", to)
+		}
+		s.dates = append(s.dates, dateRange{dateKey(fromDate), dateKey(toDate)})
+	}
+	return nil
+}
+
+func dateKey(t time.Time) int {
+	y, m, d := t.Date()
+	return y*10000 + int(m)*100 + d
+}
+
+// Contains returns true if t is within the schedule
+func (s *Schedule) Contains(t time.Time) bool {
+	t = t.In(s.location())
+	if len(s.times) == 0 {
+		return s.containsDay(t)
+	}
+
+	sec := t.Hour()*3600 + t.Minute()*60 + t.Second()
+	for _, r := range s.times {
+		switch {
+		case r.from <= r.to:
+			if sec >= r.from && sec < r.to && s.containsDay(t) {
+				return true
+			}
+		case sec >= r.from:
+			if s.containsDay(t) {
+				return true
+			}
+		case sec < r.to:
+			// the overnight range started the day before
+			if s.containsDay(t.AddDate(0, 0, -1)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsDay returns true if the local date of t matches the days of week
+// (if any) and the dates (if any)
+func (s *Schedule) containsDay(t time.Time) bool {
+	if len(s.days) > 0 {
+		found := false
+		for _, d := range s.days {
+			if d == t.Weekday() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(s.dates) > 0 {
+		key := dateKey(t)
+		for _, r := range s.dates {
+			if key >= r.from && key <= r.to {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// maxWindowSearch bounds how far ahead End looks for the end of a window
+const maxWindowSearch = 400
+
+// End returns when the window containing t ends, or a zero time if it
+// doesn't end within a year. t must be within the schedule.
+func (s *Schedule) End(t time.Time) time.Time {
+	t = t.In(s.location())
+	for i := 0; i < maxWindowSearch*(len(s.times)*2+1); i++ {
+		t = s.nextBoundary(t)
+		if !s.Contains(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// nextBoundary returns the next moment after t the schedule can change:
+// the next edge of a time range, or midnight
+func (s *Schedule) nextBoundary(t time.Time) time.Time {
+	y, m, d := t.Date()
+	sec := t.Hour()*3600 + t.Minute()*60 + t.Second()
+
+	next := 24 * 3600
+	for _, r := range s.times {
+		for _, edge := range [...]int{r.from, r.to} {
+			if edge > sec && edge < next {
+				next = edge
+			}
+		}
+	}
+	return time.Date(y, m, d, next/3600, (next%3600)/60, 0, 0, t.Location())
+}
+
+func (s *Schedule) location() *time.Location {
+	if s.Location == nil {
+		return time.Local
+	}
+	return s.Location
+}
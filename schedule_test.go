@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"socks5-server-ng/pkg/go-socks5"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedule(t *testing.T) {
+	s := &Schedule{Location: time.UTC}
+	assert.NoError(t, s.ParseTimeRanges([]string{"22:00-02:00"}))
+	assert.NoError(t, s.ParseDays([]string{"fri-sat"}))
+
+	at := func(v string) time.Time {
+		res, _ := time.Parse(time.RFC3339, v)
+		return res
+	}
+
+	assert.True(t, s.Contains(at("2026-10-16T23:00:00Z")))  // friday night
+	assert.True(t, s.Contains(at("2026-10-17T01:00:00Z")))  // saturday early, of friday night
+	assert.False(t, s.Contains(at("2026-10-17T12:00:00Z"))) // saturday noon
+	assert.True(t, s.Contains(at("2026-10-18T01:00:00Z")))  // sunday early, of saturday night
+	assert.False(t, s.Contains(at("2026-10-18T23:00:00Z"))) // sunday night
+	assert.False(t, s.Contains(at("2026-10-15T23:00:00Z"))) // thursday night
+	assert.False(t, s.Contains(at("2026-10-16T01:00:00Z"))) // friday early, of thursday night
+
+	// friday 22:00 runs through saturday 02:00
+	assert.Equal(t, at("2026-10-17T02:00:00Z"), s.End(at("2026-10-16T23:00:00Z")).UTC())
+	assert.Equal(t, at("2026-10-18T02:00:00Z"), s.End(at("2026-10-17T23:00:00Z")).UTC())
+
+	dates := &Schedule{Location: time.UTC}
+	assert.NoError(t, dates.ParseTimeRanges([]string{"20:00-04:00"}))
+	assert.NoError(t, dates.ParseDates([]string{"2026-12-31"}))
+	assert.True(t, dates.Contains(at("2027-01-01T03:00:00Z")))
+	assert.False(t, dates.Contains(at("2026-12-31T03:00:00Z")))
+
+	always := &Schedule{}
+	assert.True(t, always.End(time.Now()).IsZero())
+}
+
+func TestScheduleErrors(t *testing.T) {
+	s := &Schedule{}
+	assert.Error(t, s.ParseTimeRanges([]string{"9-17"}))
+	assert.Error(t, s.ParseDays([]string{"mon-fry"}))
+	assert.Error(t, s.ParseDates([]string{"2026-13-01"}))
+}
+
+func TestRuleSchedule(t *testing.T) {
+	rules, err := ParseRules("test.rules", strings.NewReader(
+		"allow user=bob days=mon-fri time=09:00-17:00 tz=America/New_York cut=true\n"))
+	assert.NoError(t, err)
+
+	bob := &socks5.Request{
+		Command:     socks5.ConnectCommand,
+		AuthContext: &socks5.AuthContext{Payload: map[string]string{"Username": "bob"}},
+		DestAddr:    &socks5.AddrSpec{FQDN: "example.com", Port: 443},
+	}
+
+	monday := time.Date(2026, 10, 19, 14, 0, 0, 0, time.UTC) // 10:00 in New York
+	d := rules[0].EvaluateAt(bob, monday)
+	assert.Equal(t, socks5.VerdictAllow, d.Verdict)
+	assert.Equal(t, time.Date(2026, 10, 19, 21, 0, 0, 0, time.UTC), d.Until.UTC())
+
+	assert.Equal(t, socks5.VerdictAbstain, rules[0].EvaluateAt(bob, monday.Add(8*time.Hour)).Verdict)
+
+	// an overnight session is cut the next morning, not at midnight
+	rules, err = ParseRules("test.rules", strings.NewReader("allow days=fri time=22:00-06:00 tz=UTC cut=true\n"))
+	assert.NoError(t, err)
+	friday := time.Date(2026, 10, 23, 23, 0, 0, 0, time.UTC)
+	d = rules[0].EvaluateAt(bob, friday)
+	assert.Equal(t, socks5.VerdictAllow, d.Verdict)
+	assert.Equal(t, time.Date(2026, 10, 24, 6, 0, 0, 0, time.UTC), d.Until)
+	assert.Equal(t, socks5.VerdictAllow, rules[0].EvaluateAt(bob, friday.Add(5*time.Hour)).Verdict)
+	assert.Equal(t, socks5.VerdictAbstain, rules[0].EvaluateAt(bob, friday.Add(-20*time.Hour)).Verdict)
+
+	_, err = ParseRules("test.rules", strings.NewReader("allow tz=Mars/Olympus"))
+	assert.Error(t, err)
+}
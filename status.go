@@ -3,12 +3,17 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"html/template"
+	"net"
 	"net/http"
+	"net/url"
 	"runtime"
 	"socks5-server-ng/pkg/bufpool"
+	"socks5-server-ng/pkg/domainlist"
+	"socks5-server-ng/pkg/geoip"
 	"socks5-server-ng/pkg/go-socks5"
 	"sort"
-	"text/template"
+	"strconv"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -18,10 +23,36 @@ var statusTemplate = template.Must(template.New("status").Parse(`
 <html>
 	<body>
 		<h1>Socks5 Proxy</h1>
+		<h2>Listeners</h2>
+		<table border="1" cellspacing="0" cellpadding="4">
+			<tr>
+				<th>Listener</th>
+				<th>Address</th>
+				<th>Accepted</th>
+				<th>Refused</th>
+				<th>Auth Failures</th>
+				<th>Active</th>
+				<th>Rx</th>
+				<th>Tx</th>
+			</tr>
+			{{range $l := .Listeners}}
+			<tr>
+				<td>{{$l.Name}}</td>
+				<td>{{$l.Address}}</td>
+				<td>{{$l.Accepted}}</td>
+				<td>{{$l.Refused}}</td>
+				<td>{{$l.AuthFailures}}</td>
+				<td>{{$l.Active}}</td>
+				<td>{{$l.Rx}}</td>
+				<td>{{$l.Tx}}</td>
+			</tr>
+			{{end}}
+		</table>
 		<h2>Active Hosts</h2>
 		<table border="1" cellspacing="0" cellpadding="4">
 			<tr>
 				<th>Host</th>
+				{{if $.GeoIP}}<th>Country</th><th>ASN</th>{{end}}
 				<th>Last Seen</th>
 				<th>Active</th>
 				<th>UDP</th>
@@ -31,6 +62,7 @@ var statusTemplate = template.Must(template.New("status").Parse(`
 			{{range $host := .Hosts}}
 			<tr>
 				<td>{{$host.Host}}</td>
+				{{if $.GeoIP}}<td>{{$host.Geo.Country}}</td><td>{{if $host.Geo.ASN}}AS{{$host.Geo.ASN}} {{$host.Geo.Org}}{{end}}</td>{{end}}
 				<td>{{$host.LastSeen.Format "2006-01-02 15:04:05"}}</td>
 				<td>{{$host.Active}}</td>
 				<td>{{$host.ActiveUDP}}</td>
@@ -43,6 +75,7 @@ var statusTemplate = template.Must(template.New("status").Parse(`
 		<table border="1" cellspacing="0" cellpadding="4">
 			<tr>
 				<th>Host</th>
+				{{if $.GeoIP}}<th>Country</th><th>ASN</th>{{end}}
 				<th>Active</th>
 				<th>Rx</th>
 				<th>Tx</th>
@@ -50,18 +83,152 @@ var statusTemplate = template.Must(template.New("status").Parse(`
 			{{range $host := .Targets}}
 			<tr>
 				<td>{{$host.Host}}</td>
+				{{if $.GeoIP}}<td>{{$host.Geo.Country}}</td><td>{{if $host.Geo.ASN}}AS{{$host.Geo.ASN}} {{$host.Geo.Org}}{{end}}</td>{{end}}
 				<td>{{$host.Active}}</td>
 				<td>{{$host.Rx}}</td>
 				<td>{{$host.Tx}}</td>
 			</tr>
 			{{end}}
 		</table>
+		<h2>UDP</h2>
+		<h3>Associations</h3>
+		<table border="1" cellspacing="0" cellpadding="4">
+			<tr>
+				<th>Listener</th>
+				<th>Client</th>
+				<th>Port</th>
+				<th>Started</th>
+				<th>Targets</th>
+				<th>Rx</th>
+				<th>Tx</th>
+				<th>Drops</th>
+				<th>Errors</th>
+			</tr>
+			{{range $a := .Associations}}
+			<tr>
+				<td>{{$a.Listener}}</td>
+				<td>{{$a.Client}}</td>
+				<td>{{$a.Port}}</td>
+				<td>{{$a.Started.Format "2006-01-02 15:04:05"}}</td>
+				<td>{{$a.Targets}}</td>
+				<td>{{$a.Rx}} ({{$a.RxPackets}})</td>
+				<td>{{$a.Tx}} ({{$a.TxPackets}})</td>
+				<td>{{$a.Drops}}</td>
+				<td>{{$a.Errors}}</td>
+			</tr>
+			{{end}}
+		</table>
+		<h3>Targets</h3>
+		<table border="1" cellspacing="0" cellpadding="4">
+			<tr>
+				<th>Host</th>
+				{{if $.GeoIP}}<th>Country</th><th>ASN</th>{{end}}
+				<th>Active</th>
+				<th>Rx</th>
+				<th>Tx</th>
+				<th>Drops</th>
+				<th>Errors</th>
+			</tr>
+			{{range $host := .UDPTargets}}
+			<tr>
+				<td>{{$host.Host}}</td>
+				{{if $.GeoIP}}<td>{{$host.Geo.Country}}</td><td>{{if $host.Geo.ASN}}AS{{$host.Geo.ASN}} {{$host.Geo.Org}}{{end}}</td>{{end}}
+				<td>{{$host.Active}}</td>
+				<td>{{$host.Rx}} ({{$host.RxPackets}})</td>
+				<td>{{$host.Tx}} ({{$host.TxPackets}})</td>
+				<td>{{$host.Drops}}</td>
+				<td>{{$host.Errors}}</td>
+			</tr>
+			{{end}}
+		</table>
+		{{if .Rules}}
+		<h2>Rules</h2>
+		<table border="1" cellspacing="0" cellpadding="4">
+			<tr>
+				<th>Rule</th>
+				<th>Allowed</th>
+				<th>Denied</th>
+			</tr>
+			{{range $rule := .Rules}}
+			<tr>
+				<td>{{$rule.Name}}</td>
+				<td>{{$rule.Allowed}}</td>
+				<td>{{$rule.Denied}}</td>
+			</tr>
+			{{end}}
+		</table>
+		{{end}}
+		{{if .DomainLists}}
+		<h2>Domain Lists</h2>
+		<table border="1" cellspacing="0" cellpadding="4">
+			<tr>
+				<th>List</th>
+				<th>Mode</th>
+				<th>Domains</th>
+				<th>Hits</th>
+				<th>Loaded</th>
+			</tr>
+			{{range $list := .DomainLists}}
+			<tr>
+				<td>{{$list.Path}}</td>
+				<td>{{$list.Mode}}</td>
+				<td>{{$list.Domains}}</td>
+				<td>{{$list.Hits}}</td>
+				<td>{{$list.LoadedAt.Format "2006-01-02 15:04:05"}}</td>
+			</tr>
+			{{end}}
+		</table>
+		{{end}}
+		{{if .AuthGuard}}
+		<h2>Bans</h2>
+		<strong>Total:</strong> {{.AuthGuard.TotalBans.Load}} <strong>Refused:</strong> {{.AuthGuard.Refused.Load}}<br>
+		<table border="1" cellspacing="0" cellpadding="4">
+			<tr>
+				<th>Kind</th>
+				<th>Banned</th>
+				<th>Until</th>
+				<th>Bans</th>
+				<th></th>
+			</tr>
+			{{range $ban := .Bans}}
+			<tr>
+				<td>{{$ban.Kind}}</td>
+				<td>{{$ban.Key}}</td>
+				<td>{{$ban.Until.Format "2006-01-02 15:04:05"}}</td>
+				<td>{{$ban.Count}}</td>
+				<td>
+					<form method="post" action="/unban">
+						<input type="hidden" name="kind" value="{{$ban.Kind}}">
+						<input type="hidden" name="key" value="{{$ban.Key}}">
+						<input type="submit" value="Unban">
+					</form>
+				</td>
+			</tr>
+			{{end}}
+		</table>
+		{{end}}
 		<h2>Global</h2>
 		<strong>Hosts:</strong> {{.HostCount}}<br>
 		<strong>Rx:</strong> {{.Rx}} <strong>Tx:</strong> {{.Tx}}<br>
 		<h2>Runtime</h2>
 		{{.RuntimeMetrics}}<br />
-		Pool: {{.PoolMetrics}}
+		<h3>Buffers</h3>
+		<table border="1" cellspacing="0" cellpadding="4">
+			<tr>
+				<th>Size</th>
+				<th>Pooled</th>
+				<th>Leased</th>
+				<th>Misses</th>
+			</tr>
+			{{range $pool := .Buffers}}
+			<tr>
+				<td>{{$pool.Size}}</td>
+				<td>{{$pool.Pooled}}/{{$pool.Keep}}</td>
+				<td>{{$pool.Leased}}</td>
+				<td>{{$pool.Misses}}</td>
+			</tr>
+			{{end}}
+		</table>
 		<hr />
 		<a href="/metrics">Prometheus Metrics</a>
 	</body>
@@ -84,17 +251,86 @@ func (s ByteSize) String() string {
 
 type StatusModelHost struct {
 	Host      string
+	Geo       geoip.Info
 	LastSeen  time.Time
 	Active    int64
 	ActiveUDP int64
 	Rx, Tx    ByteSize
 }
 
+type StatusModelListener struct {
+	Name, Address                   string
+	Accepted, Refused, AuthFailures int64
+	Active                          int64
+	Rx, Tx                          ByteSize
+}
+
+// StatusModelUDP counts datagrams, shown as bytes (packets)
+type StatusModelUDP struct {
+	Rx, Tx               ByteSize
+	RxPackets, TxPackets int64
+	Drops, Errors        int64
+}
+
+func newStatusModelUDP(m *socks5.UDPMetrics) StatusModelUDP {
+	return StatusModelUDP{
+		Rx:        ByteSize(m.Rx.Load()),
+		Tx:        ByteSize(m.Tx.Load()),
+		RxPackets: m.RxPackets.Load(),
+		TxPackets: m.TxPackets.Load(),
+		Drops:     m.Drops.Load(),
+		Errors:    m.Errors.Load(),
+	}
+}
+
+type StatusModelAssociation struct {
+	StatusModelUDP
+	Listener string
+	Client   string
+	Port     string
+	Started  time.Time
+	Targets  int
+}
+
+type StatusModelUDPTarget struct {
+	StatusModelUDP
+	Host   string
+	Geo    geoip.Info
+	Active int64
+}
+
+type StatusModelRule struct {
+	Name            string
+	Allowed, Denied int64
+}
+
+type StatusModelDomainList struct {
+	Path     string
+	Mode     string
+	Domains  int
+	Hits     int64
+	LoadedAt time.Time
+}
+
+type StatusModelBuffers struct {
+	Size           ByteSize
+	Pooled, Keep   int
+	Leased, Misses int64
+}
+
 type StatusModel struct {
+	Listeners      []StatusModelListener
 	Hosts          []StatusModelHost
 	Targets        []StatusModelHost
+	Associations   []StatusModelAssociation
+	UDPTargets     []StatusModelUDPTarget
+	Rules          []StatusModelRule
+	DomainLists    []StatusModelDomainList
+	GeoIP          bool
+	AuthGuard      *socks5.AuthGuard
+	Bans           []socks5.Ban
 	RuntimeMetrics string
-	PoolMetrics    string
+	Buffers        []StatusModelBuffers
 }
 
 func (s *StatusModel) Rx() (ret ByteSize) {
@@ -115,19 +351,101 @@ func (s *StatusModel) HostCount() int {
 	return len(s.Hosts)
 }
 
-func serveStatusPage(server *socks5.Server, addr string) {
+type statusPage struct {
+	listeners []*listener
+	geo       geoip.Databases
+	authGuard *socks5.AuthGuard
+}
+
+// domainLists returns the domain lists of the listeners, each once
+func (s *statusPage) domainLists(mode string) []*domainlist.List {
+	var ret []*domainlist.List
+	seen := map[*domainlist.List]bool{}
+	for _, l := range s.listeners {
+		if l.domainLists == nil {
+			continue
+		}
+		lists := l.domainLists.AllowLists
+		if mode == "deny" {
+			lists = l.domainLists.DenyLists
+		}
+		for _, list := range lists {
+			if !seen[list] {
+				seen[list] = true
+				ret = append(ret, list)
+			}
+		}
+	}
+	return ret
+}
+
+// lookup returns the GeoIP info of an address, if any database is configured
+func (s *statusPage) lookup(ip net.IP) geoip.Info {
+	if len(s.geo) == 0 || ip == nil {
+		return geoip.Info{}
+	}
+	return s.geo.Lookup(ip)
+}
+
+// sameOrigin returns whether a form was posted from the status page itself,
+// browsers sending its Origin (or at least its Referer) with POST requests
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func (s *statusPage) serve(addr string) {
+	// the listeners share their metrics
+	server := s.listeners[0].server
+	addresses := map[string]string{}
+	for _, l := range s.listeners {
+		addresses[l.name] = l.address()
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		var stats runtime.MemStats
 		runtime.ReadMemStats(&stats)
-		pool := bufpool.Pool4096
 		model := &StatusModel{
 			RuntimeMetrics: fmt.Sprintf("Heap=%d, InUse=%d, Total=%d, Sys=%d, NumGC=%d, GoRoutines=%d", stats.HeapAlloc, stats.HeapInuse, stats.TotalAlloc, stats.Sys, stats.NumGC, runtime.NumGoroutine()),
-			PoolMetrics:    fmt.Sprintf("Size=%d/%d, Leased=%d, Misses=%d", pool.MetricPoolSize(), pool.MetricMaxSize(), pool.MetricLeased(), pool.MetricMisses()),
+			GeoIP:          len(s.geo) > 0,
+		}
+		for _, pool := range bufpool.Default.Classes() {
+			model.Buffers = append(model.Buffers, StatusModelBuffers{
+				Size:   ByteSize(pool.Size()),
+				Pooled: pool.MetricPoolSize(),
+				Keep:   pool.MetricMaxSize(),
+				Leased: pool.MetricLeased(),
+				Misses: pool.MetricMisses(),
+			})
 		}
+		server.RangeListenerMetrics(func(name string, m *socks5.ListenerMetrics) {
+			model.Listeners = append(model.Listeners, StatusModelListener{
+				Name:         name,
+				Address:      addresses[name],
+				Accepted:     m.Accepted.Load(),
+				Refused:      m.Refused.Load(),
+				AuthFailures: m.AuthFailures.Load(),
+				Active:       m.Active.Load(),
+				Rx:           ByteSize(m.Rx.Load()),
+				Tx:           ByteSize(m.Tx.Load()),
+			})
+		})
+		sort.Slice(model.Listeners, func(i, j int) bool {
+			return model.Listeners[i].Name < model.Listeners[j].Name
+		})
+
 		server.RangeHostMetrics(func(host string, m *socks5.HostMetrics) {
 			model.Hosts = append(model.Hosts, StatusModelHost{
 				Host:      host,
+				Geo:       s.lookup(net.ParseIP(host)),
 				LastSeen:  m.LastSeen.Load().(time.Time),
 				Active:    m.Active.Load(),
 				ActiveUDP: m.ActiveUDP.Load(),
@@ -140,8 +458,10 @@ func serveStatusPage(server *socks5.Server, addr string) {
 		})
 
 		server.RangeTargetMetrics(func(target string, m *socks5.NetMetrics) {
+			ip, _ := m.LastIP.Load().(net.IP)
 			model.Targets = append(model.Targets, StatusModelHost{
 				Host:   target,
+				Geo:    s.lookup(ip),
 				Active: m.Active.Load(),
 				Tx:     ByteSize(m.Tx.Load()),
 				Rx:     ByteSize(m.Rx.Load()),
@@ -154,8 +474,87 @@ func serveStatusPage(server *socks5.Server, addr string) {
 			return model.Targets[i].Active > model.Targets[j].Active
 		})
 
+		for _, l := range s.listeners {
+			l.server.RangeUDPAssociations(func(a socks5.UDPAssociation) {
+				// tunneled associations relay over the client connection
+				port := "tunnel"
+				if relay, ok := a.Relay.(*net.UDPAddr); ok {
+					port = strconv.Itoa(relay.Port)
+				}
+				model.Associations = append(model.Associations, StatusModelAssociation{
+					StatusModelUDP: newStatusModelUDP(a.Metrics),
+					Listener:       a.Listener,
+					Client:         a.Client.String(),
+					Port:           port,
+					Started:        a.Started,
+					Targets:        a.Targets,
+				})
+			})
+		}
+		sort.Slice(model.Associations, func(i, j int) bool {
+			return model.Associations[i].Started.Before(model.Associations[j].Started)
+		})
+
+		server.RangeUDPTargetMetrics(func(target string, m *socks5.UDPMetrics) {
+			model.UDPTargets = append(model.UDPTargets, StatusModelUDPTarget{
+				StatusModelUDP: newStatusModelUDP(m),
+				Host:           target,
+				Geo:            s.lookup(net.ParseIP(target)),
+				Active:         m.Active.Load(),
+			})
+		})
+		sort.Slice(model.UDPTargets, func(i, j int) bool {
+			if model.UDPTargets[i].Active == model.UDPTargets[j].Active {
+				return model.UDPTargets[i].Rx > model.UDPTargets[j].Rx
+			}
+			return model.UDPTargets[i].Active > model.UDPTargets[j].Active
+		})
+
+		server.RangeRuleMetrics(func(name string, m *socks5.RuleMetrics) {
+			model.Rules = append(model.Rules, StatusModelRule{
+				Name:    name,
+				Allowed: m.Allowed.Load(),
+				Denied:  m.Denied.Load(),
+			})
+		})
+		sort.Slice(model.Rules, func(i, j int) bool {
+			return model.Rules[i].Name < model.Rules[j].Name
+		})
+
+		for _, mode := range []string{"allow", "deny"} {
+			for _, list := range s.domainLists(mode) {
+				model.DomainLists = append(model.DomainLists, StatusModelDomainList{
+					Path:     list.Path(),
+					Mode:     mode,
+					Domains:  list.Len(),
+					Hits:     list.Hits.Load(),
+					LoadedAt: list.LoadedAt(),
+				})
+			}
+		}
+
+		if s.authGuard != nil {
+			model.AuthGuard = s.authGuard
+			model.Bans = s.authGuard.CurrentBans()
+		}
+
 		statusTemplate.Execute(w, &model)
 	})
+	mux.HandleFunc("/unban", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || s.authGuard == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		kind, key := socks5.BanKind(r.FormValue("kind")), r.FormValue("key")
+		if s.authGuard.Unban(kind, key) {
+			logrus.Infof("Unbanned %s %s", kind, key)
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
 	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
 		buf := bufio.NewWriter(w)
 		defer buf.Flush()
@@ -165,11 +564,65 @@ func serveStatusPage(server *socks5.Server, addr string) {
 			buf.WriteString(fmt.Sprintf("proxy_connect_rx{remote=\"%s\"} %d\n", host, m.Rx.Load()))
 			buf.WriteString(fmt.Sprintf("proxy_connect_active{remote=\"%s\"} %d\n", host, m.Active.Load()))
 			buf.WriteString(fmt.Sprintf("proxy_connect_active_udp{remote=\"%s\"} %d\n", host, m.ActiveUDP.Load()))
-			for i := 0; i < len(m.Commands); i++ {
-				buf.WriteString(fmt.Sprintf("proxy_connect_count{remote=\"%s\",command=\"%d\"} %d\n", host, i, m.Commands[i].Load()))
+			for i, cmd := range socks5.HostCommands {
+				buf.WriteString(fmt.Sprintf("proxy_connect_count{remote=\"%s\",command=\"%d\"} %d\n", host, cmd, m.Commands[i].Load()))
 			}
 		})
 
+		server.RangeListenerMetrics(func(name string, m *socks5.ListenerMetrics) {
+			buf.WriteString(fmt.Sprintf("proxy_listener_accepted{listener=\"%s\"} %d\n", name, m.Accepted.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_listener_refused{listener=\"%s\"} %d\n", name, m.Refused.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_listener_auth_failures{listener=\"%s\"} %d\n", name, m.AuthFailures.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_listener_active{listener=\"%s\"} %d\n", name, m.Active.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_listener_rx{listener=\"%s\"} %d\n", name, m.Rx.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_listener_tx{listener=\"%s\"} %d\n", name, m.Tx.Load()))
+		})
+
+		for _, l := range s.listeners {
+			associations := 0
+			l.server.RangeUDPAssociations(func(a socks5.UDPAssociation) {
+				associations++
+			})
+			buf.WriteString(fmt.Sprintf("proxy_udp_associations{listener=\"%s\"} %d\n", l.name, associations))
+		}
+		server.RangeUDPTargetMetrics(func(target string, m *socks5.UDPMetrics) {
+			buf.WriteString(fmt.Sprintf("proxy_udp_target_active{target=\"%s\"} %d\n", target, m.Active.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_udp_target_tx{target=\"%s\"} %d\n", target, m.Tx.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_udp_target_rx{target=\"%s\"} %d\n", target, m.Rx.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_udp_target_tx_packets{target=\"%s\"} %d\n", target, m.TxPackets.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_udp_target_rx_packets{target=\"%s\"} %d\n", target, m.RxPackets.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_udp_target_drops{target=\"%s\"} %d\n", target, m.Drops.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_udp_target_errors{target=\"%s\"} %d\n", target, m.Errors.Load()))
+		})
+
+		server.RangeRuleMetrics(func(name string, m *socks5.RuleMetrics) {
+			buf.WriteString(fmt.Sprintf("proxy_rule_decisions{rule=\"%s\",verdict=\"allow\"} %d\n", name, m.Allowed.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_rule_decisions{rule=\"%s\",verdict=\"deny\"} %d\n", name, m.Denied.Load()))
+		})
+
+		for _, mode := range []string{"allow", "deny"} {
+			for _, list := range s.domainLists(mode) {
+				buf.WriteString(fmt.Sprintf("proxy_domain_list_hits{list=\"%s\",mode=\"%s\"} %d\n", list.Path(), mode, list.Hits.Load()))
+			}
+		}
+
+		if s.authGuard != nil {
+			banned := map[socks5.BanKind]int{socks5.BanIP: 0, socks5.BanUser: 0}
+			for _, ban := range s.authGuard.CurrentBans() {
+				banned[ban.Kind]++
+			}
+			buf.WriteString(fmt.Sprintf("proxy_auth_bans_total %d\n", s.authGuard.TotalBans.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_auth_refused_total %d\n", s.authGuard.Refused.Load()))
+			buf.WriteString(fmt.Sprintf("proxy_auth_banned{kind=\"ip\"} %d\n", banned[socks5.BanIP]))
+			buf.WriteString(fmt.Sprintf("proxy_auth_banned{kind=\"user\"} %d\n", banned[socks5.BanUser]))
+		}
+
+		for _, pool := range bufpool.Default.Classes() {
+			buf.WriteString(fmt.Sprintf("proxy_buffers_pooled{size=\"%d\"} %d\n", pool.Size(), pool.MetricPoolSize()))
+			buf.WriteString(fmt.Sprintf("proxy_buffers_leased{size=\"%d\"} %d\n", pool.Size(), pool.MetricLeased()))
+			buf.WriteString(fmt.Sprintf("proxy_buffers_misses{size=\"%d\"} %d\n", pool.Size(), pool.MetricMisses()))
+		}
+
 		var stats runtime.MemStats
 		runtime.ReadMemStats(&stats)
 
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"socks5-server-ng/pkg/go-socks5"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusTemplateEscapes(t *testing.T) {
+	guard := socks5.NewAuthGuard(socks5.AuthGuardConfig{})
+	defer guard.Close()
+	model := &StatusModel{
+		AuthGuard: guard,
+		Bans:      []socks5.Ban{{Kind: socks5.BanUser, Key: `"><script>alert(1)</script>`}},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, statusTemplate.Execute(&buf, model))
+	assert.NotContains(t, buf.String(), "<script>")
+	assert.Contains(t, buf.String(), "&lt;script&gt;")
+}
+
+func TestSameOrigin(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://status.local:8080/unban", nil)
+	assert.False(t, sameOrigin(r))
+
+	r.Header.Set("Origin", "http://status.local:8080")
+	assert.True(t, sameOrigin(r))
+	r.Header.Set("Origin", "http://evil.example")
+	assert.False(t, sameOrigin(r))
+
+	r.Header.Del("Origin")
+	r.Header.Set("Referer", "http://status.local:8080/")
+	assert.True(t, sameOrigin(r))
+}
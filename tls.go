@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"socks5-server-ng/pkg/filewatch"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TLSFiles is a certificate and key, and optionally client CAs, loaded from
+// files and reloaded when they change
+type TLSFiles struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string // enables client certificates
+	// RequireClientCert refuses clients without a verified certificate,
+	// rather than letting them use a password
+	RequireClientCert bool
+
+	cert      atomic.Pointer[tls.Certificate]
+	clientCAs atomic.Pointer[x509.CertPool]
+}
+
+// Load (re)loads the files, keeping the previous ones on error
+func (f *TLSFiles) Load() error {
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if f.ClientCAFile != "" {
+		pem, err := os.ReadFile(f.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no PEM certificates", f.ClientCAFile)
+		}
+	}
+
+	f.cert.Store(&cert)
+	f.clientCAs.Store(pool)
+	return nil
+}
+
+// Config returns a tls.Config using the latest loaded files
+func (f *TLSFiles) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*f.cert.Load()},
+			}
+			if pool := f.clientCAs.Load(); pool != nil {
+				config.ClientCAs = pool
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				if f.RequireClientCert {
+					config.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return config, nil
+		},
+	}
+}
+
+// openTLS loads the TLS files, and watches them for changes
+func openTLS(files *TLSFiles, pollInterval time.Duration) error {
+	if err := files.Load(); err != nil {
+		return err
+	}
+	for _, path := range []string{files.CertFile, files.KeyFile, files.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		filewatch.Watch(path, pollInterval, func() {
+			if err := files.Load(); err != nil {
+				logrus.Warnf("Failed to reload TLS files: %v", err)
+				return
+			}
+			logrus.Infof("Reloaded TLS certificate %s", files.CertFile)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCert writes a self-signed certificate and its key, returning the certificate
+func writeTestCert(t *testing.T, certFile, keyFile, name string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return der
+}
+
+func TestTLSFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := &TLSFiles{
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		ClientCAFile: filepath.Join(dir, "cert.pem"),
+	}
+	first := writeTestCert(t, files.CertFile, files.KeyFile, "first")
+	assert.NoError(t, files.Load())
+
+	config := func() *tls.Config {
+		c, err := files.Config().GetConfigForClient(&tls.ClientHelloInfo{})
+		assert.NoError(t, err)
+		return c
+	}
+	assert.Equal(t, first, config().Certificates[0].Certificate[0])
+	assert.Equal(t, tls.VerifyClientCertIfGiven, config().ClientAuth)
+	assert.NotNil(t, config().ClientCAs)
+
+	files.RequireClientCert = true
+	assert.Equal(t, tls.RequireAndVerifyClientCert, config().ClientAuth)
+
+	second := writeTestCert(t, files.CertFile, files.KeyFile, "second")
+	assert.NoError(t, files.Load())
+	assert.Equal(t, second, config().Certificates[0].Certificate[0])
+
+	// broken files keep the previous certificate
+	assert.NoError(t, os.WriteFile(files.KeyFile, []byte("garbage"), 0o600))
+	assert.Error(t, files.Load())
+	assert.Equal(t, second, config().Certificates[0].Certificate[0])
+}
+
+func TestTLSFilesWithoutClientCA(t *testing.T) {
+	dir := t.TempDir()
+	files := &TLSFiles{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	writeTestCert(t, files.CertFile, files.KeyFile, "server")
+	assert.NoError(t, files.Load())
+
+	c, err := files.Config().GetConfigForClient(&tls.ClientHelloInfo{})
+	assert.NoError(t, err)
+	assert.Equal(t, tls.NoClientCert, c.ClientAuth)
+	assert.Nil(t, c.ClientCAs)
+}